@@ -0,0 +1,445 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const goterraTmplPre string = `#!/bin/sh
+if [ -z "$BASH_VERSION" ]; then
+	if [ -z "$(command -v bash)" ] && [ -n "$(command -v apk)" ]; then
+		apk add --no-cache bash coreutils util-linux
+	fi
+	exec bash "$0" "$@"
+fi
+set -e
+
+export TOKEN="${GOT_TOKEN}"
+
+${GOT_STORE_CLIENT}
+
+GOT_RECIPE=""
+GOT_FAILURE=failed
+
+got_ship_log () {
+	if [ -e /opt/got/${GOT_ID}.log ]; then
+		tail -c ${GOT_LOG_MAX_BYTES} /opt/got/${GOT_ID}.log > /opt/got/${GOT_ID}.log.tail
+		got_put_file _log_app_${GOT_NAME}_${HOSTNAME} /opt/got/${GOT_ID}.log.tail
+	fi
+}
+
+got_log_shipper () {
+	local sleeper
+	set +e
+	trap - ERR
+	trap 'kill $sleeper 2> /dev/null; exit 0' TERM
+	while true; do
+		sleep ${GOT_LOG_INTERVAL} &
+		sleeper=$!
+		wait $sleeper
+		got_ship_log
+	done
+}
+
+GOT_LOG_SHIPPER=""
+
+got_stop_log_shipper () {
+	if [ -n "$GOT_LOG_SHIPPER" ]; then
+		kill $GOT_LOG_SHIPPER 2> /dev/null || true
+		wait $GOT_LOG_SHIPPER 2> /dev/null || true
+		GOT_LOG_SHIPPER=""
+	fi
+}
+
+trap got_stop_log_shipper EXIT
+
+ON_ERROR () {
+	trap ERR
+	got_stop_log_shipper
+	got_ship_log || true
+	got_put status_app_${GOT_NAME}_${HOSTNAME} "$GOT_FAILURE${GOT_RECIPE:+:$GOT_RECIPE}"
+	exit 1
+}
+
+trap ON_ERROR ERR
+
+got_sha256 () {
+	printf '%s' "$(cat "$1")" | sha256sum | cut -d' ' -f1
+}
+
+got_recipe_start () {
+	GOT_RECIPE="$1"
+	GOT_RECIPE_START=$(date +%s)
+	got_put status_recipe_${GOT_NAME}_$1_${HOSTNAME} "status=start start=$GOT_RECIPE_START"
+}
+
+GOT_KILL_GRACE=30
+
+got_run_recipe () {
+	local attempt=0 rc pgid
+	while true; do
+		rc=0
+		if [ "$2" -gt 0 ]; then
+			# recipe runs in its own process group, killed with its children on timeout
+			setsid timeout -k $GOT_KILL_GRACE "$2" /opt/got/$1.sh &>> /opt/got/${GOT_ID}.log &
+			pgid=$!
+			wait $pgid || rc=$?
+			if [ $rc -eq 124 ] || [ $rc -eq 137 ]; then
+				rc=124
+				kill -KILL -- -$pgid 2> /dev/null || true
+			fi
+		else
+			/opt/got/$1.sh &>> /opt/got/${GOT_ID}.log || rc=$?
+		fi
+		if [ $rc -eq 0 ] || [ $attempt -ge "$3" ]; then
+			return $rc
+		fi
+		attempt=$((attempt + 1))
+		echo "[WARN] recipe $1 failed with code $rc, retry $attempt/$3" >> /opt/got/${GOT_ID}.log
+	done
+}
+
+got_recipe_end () {
+	local status=over
+	if [ "$2" != "0" ]; then
+		status=failed
+	fi
+	if [ "$2" = "124" ] && [ "$3" -gt 0 ]; then
+		status=timeout
+		GOT_FAILURE=timeout
+	fi
+	got_put status_recipe_${GOT_NAME}_$1_${HOSTNAME} "status=$status start=$GOT_RECIPE_START end=$(date +%s) exit=$2"
+	if [ "$2" != "0" ]; then
+		ON_ERROR
+	fi
+	GOT_RECIPE=""
+}
+
+got_integrity_failed () {
+	trap ERR
+	echo "[ERROR] integrity check of $1 failed"
+	got_stop_log_shipper
+	got_ship_log || true
+	got_put status_app_${GOT_NAME}_${HOSTNAME} integrity_failed
+	exit 1
+}
+
+echo "Set up goterra"
+
+if [ -n "$(command -v dnf)" ]; then
+    dnf -y install curl dos2unix
+elif [ -n "$(command -v yum)" ]; then
+    yum -y install curl dos2unix
+elif [ -n "$(command -v apt)" ]; then
+	export DEBIAN_NONINTERACTIVE=1
+	systemctl stop apt-daily.timer || true
+	systemctl disable apt-daily.timer || true
+	systemctl mask apt-daily.service || true
+	systemctl daemon-reload
+	apt-get purge -y unattended-upgrades || true
+	time (while ps -opid= -C apt-get > /dev/null; do sleep 1; done); echo "Waiting for apt unlock"
+    apt-get update && apt-get install -y  curl dos2unix
+elif [ -n "$(command -v zypper)" ]; then
+    zypper --non-interactive install curl dos2unix
+elif [ -n "$(command -v apk)" ]; then
+    apk add --no-cache curl dos2unix
+fi
+
+get_latest_release() {
+	curl --silent "https://api.github.com/repos/osallou/goterra-store/releases/latest" |
+	  grep '"tag_name":' |
+	  sed -E 's/.*"([^"]+)".*/\1/'
+}
+
+send_start_ts() {
+	cur=` + "`date +%s`" + `
+	got_put ts_start_${GOT_NAME}_${HOSTNAME} $cur
+}
+
+send_end_ts() {
+	cur=` + "`date +%s`" + `
+	got_put ts_end_${GOT_NAME}_${HOSTNAME} $cur
+}
+
+echo "[INFO] initialization"
+
+${GOT_CLI_SETUP}
+if [ ${GOT_LOG_INTERVAL} -gt 0 ]; then
+	got_log_shipper > /dev/null 2>&1 < /dev/null &
+	GOT_LOG_SHIPPER=$!
+fi
+
+send_start_ts
+
+got_put status_app_${GOT_NAME}_${HOSTNAME} start
+`
+const goterraTmpPost string = `
+echo "[INFO] setup is over"
+send_end_ts
+got_stop_log_shipper
+got_ship_log
+got_put status_app_${GOT_NAME}_${HOSTNAME} over
+
+`
+
+// goterraStubTmpl is a minimal script fetching the full application script from store and running it
+//
+// Full script is stored base64 encoded, so that it can be decoded without a json parser.
+// Script checksum is verified before execution, status is set to failed if script cannot be fetched
+// or decoded.
+// curl, or wget if curl is not installed, is needed to fetch the script.
+// Stub is a POSIX sh script, full script installs bash with apk if missing.
+const goterraStubTmpl string = `#!/bin/sh
+set -e
+mkdir -p /opt/got
+if [ -z "$HOSTNAME" ]; then
+	HOSTNAME=$(uname -n)
+fi
+
+got_fetch () {
+	if [ -n "$(command -v curl)" ]; then
+		curl --silent --fail --retry 5 -H "Authorization: Bearer ${GOT_TOKEN}" "$1"
+	elif [ -n "$(command -v wget)" ]; then
+		wget -q --tries=5 -O - --header "Authorization: Bearer ${GOT_TOKEN}" "$1"
+	else
+		echo "[ERROR] curl or wget is needed to fetch bootstrap script" >&2
+		return 1
+	fi
+}
+
+got_put_status () {
+	got_body="{\"key\": \"status_app_${GOT_NAME}_${HOSTNAME}\", \"value\": \"$1\"}"
+	if [ -n "$(command -v curl)" ]; then
+		curl --silent -X PUT -H "Authorization: Bearer ${GOT_TOKEN}" -H "Content-Type: application/json" -d "$got_body" ${GOT_URL}/store/${GOT_DEP} || true
+	elif [ -n "$(command -v wget)" ]; then
+		wget -q -O /dev/null --method=PUT --header "Authorization: Bearer ${GOT_TOKEN}" --header "Content-Type: application/json" --body-data "$got_body" ${GOT_URL}/store/${GOT_DEP} || true
+	fi
+}
+
+if ! resp=$(got_fetch ${GOT_URL}/store/${GOT_DEP}/${GOT_BOOTSTRAP_KEY}); then
+	echo "[ERROR] failed to fetch bootstrap script"
+	got_put_status failed
+	exit 1
+fi
+if ! printf '%s' "$resp" | sed -e 's/.*"[Vv]alue" *: *"\([^"]*\)".*/\1/' | base64 -d > /opt/got/${GOT_BOOTSTRAP_KEY}.sh; then
+	echo "[ERROR] failed to decode bootstrap script"
+	got_put_status failed
+	exit 1
+fi
+if [ "$(sha256sum /opt/got/${GOT_BOOTSTRAP_KEY}.sh | cut -d' ' -f1)" != "${GOT_BOOTSTRAP_SHA256}" ]; then
+	echo "[ERROR] integrity check of bootstrap script failed"
+	got_put_status integrity_failed
+	exit 1
+fi
+chmod +x /opt/got/${GOT_BOOTSTRAP_KEY}.sh
+exec /opt/got/${GOT_BOOTSTRAP_KEY}.sh
+`
+
+// embeddedRecipeFunction is the name of the function writing embedded recipe at index
+func embeddedRecipeFunction(index int) string {
+	return fmt.Sprintf("got_write_recipe_%d", index)
+}
+
+// embeddedRecipeScript defines a function writing recipe script to /opt/got with a heredoc
+func embeddedRecipeScript(recipe RenderedRecipe, index int) string {
+	script := recipe.script
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	delimiter := "GOT_EOF_" + strings.TrimPrefix(recipe.key, "_recipe_")
+	recipeTxt := fmt.Sprintf("%s () {\n", embeddedRecipeFunction(index))
+	recipeTxt += fmt.Sprintf("cat > /opt/got/%s.sh <<'%s'\n", recipe.key, delimiter)
+	recipeTxt += script
+	recipeTxt += delimiter + "\n"
+	recipeTxt += "}\n"
+	return recipeTxt
+}
+
+// recipeStatusNameRegexp matches characters not allowed in recipe status keys
+var recipeStatusNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// recipeStatusName returns recipe name usable in recipe status key
+func recipeStatusName(name string) string {
+	return recipeStatusNameRegexp.ReplaceAllString(name, "-")
+}
+
+// recipeRunScript generates the script part fetching (or writing, if embedded) and executing a recipe,
+// unless already executed
+//
+// A fetched recipe is not executed, and status is set to integrity_failed, if its checksum does not match.
+// Recipe status, start and end timestamps and exit code are set in status_recipe_<GOT_NAME>_<recipe>_<host> key.
+// Recipe is stopped after policy timeout, with a timeout status, and run again on failure up to policy retries.
+func recipeRunScript(options ApplicationOptions, recipe RenderedRecipe, policy RecipePolicy, index int) string {
+	recipeIndex := recipe.key
+	scriptTxt := "\n"
+	scriptTxt += fmt.Sprintf("if [ -f %s.done ]; then\n", recipeIndex)
+	scriptTxt += "    echo \"recipe already executed, skipping\"\n"
+	scriptTxt += "else\n"
+	if options.embedRecipes {
+		scriptTxt += fmt.Sprintf("    %s\n", embeddedRecipeFunction(index))
+	} else {
+		scriptTxt += fmt.Sprintf("    got_get %s > /opt/got/%s.sh\n", recipeIndex, recipeIndex)
+		scriptTxt += fmt.Sprintf("    if [ \"$(got_sha256 /opt/got/%s.sh)\" != \"%s\" ]; then\n", recipeIndex, recipe.checksum)
+		scriptTxt += fmt.Sprintf("        got_integrity_failed %s\n", shellQuote("recipe "+recipe.name))
+		scriptTxt += "    fi\n"
+	}
+	scriptTxt += fmt.Sprintf("    dos2unix /opt/got/%s.sh\n", recipeIndex)
+	scriptTxt += fmt.Sprintf("    chmod +x /opt/got/%s.sh\n", recipeIndex)
+	scriptTxt += fmt.Sprintf("    got_recipe_start %s\n", recipeStatusName(recipe.name))
+	scriptTxt += fmt.Sprintf("    got_run_recipe %s %d %d && got_rc=0 || got_rc=$?\n", recipeIndex, policy.timeout, policy.retries)
+	scriptTxt += fmt.Sprintf("    got_recipe_end %s $got_rc %d\n", recipeStatusName(recipe.name), policy.timeout)
+	scriptTxt += fmt.Sprintf("    touch %s.done\n", recipeIndex)
+	scriptTxt += "fi\n"
+	return scriptTxt
+}
+
+// Bootstrap modes, full script in user data or stub fetching it from store
+const (
+	bootstrapFull string = "full"
+	bootstrapStub string = "stub"
+)
+
+// validateBootstrapMode checks mode is a supported bootstrap mode
+func validateBootstrapMode(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value != bootstrapFull && value != bootstrapStub {
+		errors = append(errors, fmt.Errorf("%q must be %s or %s", k, bootstrapFull, bootstrapStub))
+	}
+	return
+}
+
+// goterraCLIClient defines store functions using goterra-cli
+const goterraCLIClient string = `got_put () {
+	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put "$1" "$2"
+}
+
+got_put_file () {
+	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put "$1" "@$2"
+}
+
+got_get () {
+	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN get "$1"
+}
+`
+
+// goterraCurlClient defines store functions calling goterra-store API with curl
+//
+// Values set by provider (recipes) are base64 encoded so that got_get
+// does not need a json parser on host.
+const goterraCurlClient string = `got_json_escape () {
+	tr -d '\000-\010\013\014\016-\037' | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g' -e 's/\t/\\t/g' -e 's/\r/\\r/g' | awk 'NR > 1 {printf "\\n"} {printf "%s", $0}'
+}
+
+got_put_file () {
+	local body rc=0
+	body=$(mktemp)
+	{ printf '{"key":"%s","value":"' "$1"; got_json_escape < "$2"; printf '"}'; } > $body
+	curl --silent --fail -X PUT -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/json" --data-binary @$body ${GOT_URL}/store/${GOT_DEP} > /dev/null || rc=$?
+	rm -f $body
+	return $rc
+}
+
+got_put () {
+	local value rc=0
+	value=$(mktemp)
+	printf '%s' "$2" > $value
+	got_put_file "$1" $value || rc=$?
+	rm -f $value
+	return $rc
+}
+
+got_get () {
+	local resp
+	resp=$(curl --silent --fail -H "Authorization: Bearer $TOKEN" ${GOT_URL}/store/${GOT_DEP}/$1) || return $?
+	printf '%s' "$resp" | sed -e 's/.*"[Vv]alue" *: *"\([^"]*\)".*/\1/' | base64 -d
+}
+`
+
+// Store clients available in generated scripts
+const (
+	clientCLI  string = "cli"
+	clientCurl string = "curl"
+)
+
+// storeClientScript returns the store functions for selected client
+func storeClientScript(options ApplicationOptions) string {
+	if options.client == clientCurl {
+		return goterraCurlClient
+	}
+	return goterraCLIClient
+}
+
+// validateClient checks client is a supported store client
+func validateClient(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value != clientCLI && value != clientCurl {
+		errors = append(errors, fmt.Errorf("%q must be %s or %s", k, clientCLI, clientCurl))
+	}
+	return
+}
+
+// goterraCLIURL is the default download location of goterra-cli
+//
+// {version}, {os} and {arch} are replaced by the cli version, host os and architecture
+const goterraCLIURL string = "https://github.com/osallou/goterra-store/releases/download/{version}/goterra-cli.{os}.{arch}"
+
+// goterraPlatformDetect sets host os and architecture, matching goterra-cli release names, if not already defined
+const goterraPlatformDetect string = `if [ -z "$clios" ]; then
+	clios=$(uname -s | tr '[:upper:]' '[:lower:]')
+fi
+if [ -z "$cliarch" ]; then
+	case $(uname -m) in
+		x86_64|amd64) cliarch=amd64 ;;
+		aarch64|arm64) cliarch=arm64 ;;
+		armv6l|armv7l) cliarch=arm ;;
+		i386|i686) cliarch=386 ;;
+		ppc64le) cliarch=ppc64le ;;
+		s390x) cliarch=s390x ;;
+		*) cliarch=$(uname -m) ;;
+	esac
+fi
+`
+
+// cliSetupScript generates the script part downloading goterra-cli, if needed
+//
+// If no version is set and url depends on it, latest release is fetched from github on boot.
+// If os or architecture are not set, they are detected on host.
+// If a checksum is set, binary is removed and setup fails if it does not match.
+func cliSetupScript(options ApplicationOptions) string {
+	script := "mkdir -p /opt/got\n"
+	if options.client == clientCurl {
+		return script
+	}
+	cliURL := goterraCLIURL
+	if options.cliURL != "" {
+		cliURL = options.cliURL
+	}
+	if options.cliVersion != "" {
+		script += fmt.Sprintf("cliversion=%s\n", shellQuote(options.cliVersion))
+	} else if strings.Contains(cliURL, "{version}") {
+		script += "cliversion=`get_latest_release`\n"
+	}
+	if options.cliOS != "" {
+		script += fmt.Sprintf("clios=%s\n", shellQuote(options.cliOS))
+	}
+	if options.cliArch != "" {
+		script += fmt.Sprintf("cliarch=%s\n", shellQuote(options.cliArch))
+	}
+	script += goterraPlatformDetect
+	// url is quoted, placeholders are replaced by quoted shell variables
+	cliURL = shellQuote(cliURL)
+	cliURL = strings.Replace(cliURL, "{version}", `'"${cliversion}"'`, -1)
+	cliURL = strings.Replace(cliURL, "{os}", `'"${clios}"'`, -1)
+	cliURL = strings.Replace(cliURL, "{arch}", `'"${cliarch}"'`, -1)
+	script += fmt.Sprintf("curl --fail -L -o /opt/got/goterra-cli %s\n", cliURL)
+	if options.cliSHA256 != "" {
+		script += fmt.Sprintf("if ! echo \"%s  /opt/got/goterra-cli\" | sha256sum -c - ; then\n", options.cliSHA256)
+		script += "    echo \"[ERROR] goterra-cli checksum mismatch\"\n"
+		script += "    rm -f /opt/got/goterra-cli\n"
+		script += "    exit 1\n"
+		script += "fi\n"
+	}
+	script += "chmod +x /opt/got/goterra-cli\n"
+	return script
+}
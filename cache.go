@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+// maxConcurrentRequests is the maximum number of parallel requests to goterra per resource
+const maxConcurrentRequests = 8
+
+// recipeEntry is a cached recipe, ready is closed once recipe is fetched
+type recipeEntry struct {
+	ready  chan struct{}
+	recipe *terraModel.Recipe
+	err    error
+}
+
+// RecipeCache keeps fetched recipes for the provider lifetime, shared by all resources
+//
+// Recipes are keyed by goterra address, namespace and recipe id. Concurrent requests
+// for the same recipe wait for the first fetch. Failed fetches are not kept.
+// Cached recipes are shared and must not be modified.
+type RecipeCache struct {
+	mutex   sync.Mutex
+	recipes map[string]*recipeEntry
+}
+
+func newRecipeCache() *RecipeCache {
+	return &RecipeCache{recipes: make(map[string]*recipeEntry)}
+}
+
+// get returns recipe from cache or fetches it from goterra-deploy
+func (c *RecipeCache) get(options ApplicationOptions, recipeID string) (*terraModel.Recipe, error) {
+	if c == nil {
+		return getRecipe(options, recipeID)
+	}
+	key := options.url + "/" + options.namespace + "/" + recipeID
+	c.mutex.Lock()
+	entry, ok := c.recipes[key]
+	if ok {
+		c.mutex.Unlock()
+		<-entry.ready
+		return entry.recipe, entry.err
+	}
+	entry = &recipeEntry{ready: make(chan struct{})}
+	c.recipes[key] = entry
+	c.mutex.Unlock()
+
+	entry.recipe, entry.err = getRecipe(options, recipeID)
+	if entry.err != nil {
+		c.mutex.Lock()
+		delete(c.recipes, key)
+		c.mutex.Unlock()
+	}
+	close(entry.ready)
+	return entry.recipe, entry.err
+}
+
+// runConcurrently calls fn for each index in [0, count), with at most maxConcurrentRequests
+// parallel calls, and returns the first error met
+func runConcurrently(count int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, maxConcurrentRequests)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(i); err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
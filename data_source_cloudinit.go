@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// dataSourceCloudinit renders application scripts like goterra_application, without publishing them
+//
+// Arguments are the goterra_application arguments used for rendering.
+func dataSourceCloudinit() *schema.Resource {
+	appSchema := resourceApplication().Schema
+	dataSchema := map[string]*schema.Schema{
+		"recipe_tags": appSchema["recipe_tags"],
+		"got_name": {
+			Type:         schema.TypeString,
+			Optional:     true,
+			Computed:     true,
+			ValidateFunc: validateSetupName,
+			Description:  "Setup name, generated if name and got_name are empty",
+		},
+		"rendered": {
+			Type:     schema.TypeString,
+			Computed: true,
+		},
+		"rendered_instances": {
+			Type: schema.TypeList,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+			Computed: true,
+		},
+		"got_names": {
+			Type: schema.TypeList,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+			Computed: true,
+		},
+		"script_hash": {
+			Type:     schema.TypeString,
+			Computed: true,
+		},
+		"resolved_recipes": {
+			Type: schema.TypeList,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+			Computed: true,
+		},
+	}
+	for _, key := range applicationRenderKeys {
+		dataSchema[key] = appSchema[key]
+	}
+	return &schema.Resource{
+		Read:   dataSourceCloudinitRead,
+		Schema: dataSchema,
+	}
+}
+
+// dataSourceCloudinitRead renders application, nothing is written to the store nor to disk
+func dataSourceCloudinitRead(d *schema.ResourceData, m interface{}) error {
+	options, err := applicationOptions(d, m)
+	if err != nil {
+		return err
+	}
+	rendering, err := renderApp(options)
+	if err != nil {
+		return err
+	}
+	if options.bootstrapMode == bootstrapStub || (!options.embedRecipes && len(rendering.recipes) > 0) {
+		log.Printf("[WARN] rendered script of %s fetches content from store, which is not published by goterra_cloudinit", options.application)
+	}
+	rendered := make([]string, len(rendering.instances))
+	for i, instance := range rendering.instances {
+		rendered[i] = instance.userData
+	}
+	d.SetId(rendering.hash)
+	d.Set("rendered", rendered[0])
+	d.Set("rendered_instances", rendered)
+	d.Set("got_name", rendering.gotName)
+	d.Set("got_names", rendering.gotNames())
+	d.Set("script_hash", rendering.hash)
+	d.Set("resolved_recipes", rendering.recipeIDs())
+	return nil
+}
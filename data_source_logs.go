@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// dataSourceLogs fetches logs uploaded by hosts of application setups
+func dataSourceLogs() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceLogsRead,
+
+		Schema: map[string]*schema.Schema{
+			"address": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"deployment": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"deployment_token": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"deployment_address": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"got_names": {
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Required:    true,
+				Description: "Setup names of application instances, goterra_application got_names",
+			},
+			"logs": {
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed:    true,
+				Description: "Last uploaded log of each host, by host name",
+			},
+		},
+	}
+}
+
+// dataSourceLogsRead fetches _log_app_<GOT_NAME>_<host> keys of setups
+func dataSourceLogsRead(d *schema.ResourceData, m interface{}) error {
+	options := applicationStoreOptions(d, m)
+	gotNames := make([]string, 0)
+	for _, gotName := range d.Get("got_names").([]interface{}) {
+		gotNames = append(gotNames, gotName.(string))
+	}
+	keys, err := listStoreKeys(options)
+	if err != nil {
+		return err
+	}
+	logKeys := make([]string, 0)
+	hosts := make([]string, 0)
+	for _, key := range keys {
+		for _, gotName := range gotNames {
+			prefix := "_log_app_" + gotName + "_"
+			if strings.HasPrefix(key, prefix) {
+				logKeys = append(logKeys, key)
+				hosts = append(hosts, strings.TrimPrefix(key, prefix))
+				break
+			}
+		}
+	}
+	values := make([]string, len(logKeys))
+	err = runConcurrently(len(logKeys), func(i int) error {
+		value, _, err := getStoreValue(options, logKeys[i])
+		values[i] = value
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logs := make(map[string]interface{})
+	for i, host := range hosts {
+		logs[host] = values[i]
+	}
+	log.Printf("[DEBUG] fetched logs of %d hosts", len(logs))
+	d.SetId(options.deployment + "-" + strings.Join(gotNames, "-"))
+	d.Set("logs", logs)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+// includeRegexp matches include directive lines of recipe scripts
+var includeRegexp = regexp.MustCompile(`^\s*#\s*goterra:include\s+(\S+)\s*$`)
+
+// includeExpander expands include directives of a recipe script
+//
+// included recipes are expanded once per script, later includes of the same recipe are skipped.
+type includeExpander struct {
+	options     ApplicationOptions
+	refResolver *recipeRefResolver
+	included    map[string]bool
+	visiting    map[string]bool
+	path        []string
+	sources     []terraModel.Recipe
+}
+
+// expandIncludes replaces `# goterra:include <recipe-ref>` lines of recipe script with included recipe script
+//
+// Includes are expanded recursively, references being relative to the namespace of the including recipe.
+// Only script of included recipes is inserted, their parent recipes are ignored.
+// An include cycle is reported as an error.
+func expandIncludes(options ApplicationOptions, refResolver *recipeRefResolver, recipe *ResolvedRecipe) error {
+	expander := &includeExpander{
+		options:     options,
+		refResolver: refResolver,
+		included:    map[string]bool{recipe.id: true},
+		visiting:    map[string]bool{recipe.id: true},
+		path:        []string{fmt.Sprintf("%s:%s", recipe.name, recipe.id)},
+	}
+	script, err := expander.expand(recipe.namespace, recipe.script)
+	if err != nil {
+		return fmt.Errorf("failed to expand includes of recipe %s: %s", recipe.name, err)
+	}
+	recipe.script = script
+	recipe.sources = append(recipe.sources, expander.sources...)
+	return nil
+}
+
+func (e *includeExpander) expand(namespace string, script string) (string, error) {
+	if !strings.Contains(script, "goterra:include") {
+		return script, nil
+	}
+	var expanded strings.Builder
+	for _, line := range strings.SplitAfter(script, "\n") {
+		match := includeRegexp.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if match == nil {
+			expanded.WriteString(line)
+			continue
+		}
+		refs, err := e.refResolver.resolve(namespace, []string{match[1]})
+		if err != nil {
+			return "", err
+		}
+		ref := refs[0]
+		if e.visiting[ref.id] {
+			return "", fmt.Errorf("include cycle detected: %s -> %s", strings.Join(e.path, " -> "), match[1])
+		}
+		if e.included[ref.id] {
+			expanded.WriteString(fmt.Sprintf("# goterra:include %s already included\n", match[1]))
+			continue
+		}
+		nsOptions := e.options
+		nsOptions.namespace = ref.namespace
+		recipe, err := e.options.cache.get(nsOptions, ref.id)
+		if err != nil {
+			return "", err
+		}
+		e.included[ref.id] = true
+		e.sources = append(e.sources, *recipe)
+		e.visiting[ref.id] = true
+		e.path = append(e.path, fmt.Sprintf("%s:%s", recipe.Name, ref.id))
+		includedScript, err := e.expand(ref.namespace, recipe.Script)
+		if err != nil {
+			return "", err
+		}
+		e.path = e.path[:len(e.path)-1]
+		e.visiting[ref.id] = false
+
+		expanded.WriteString(fmt.Sprintf("#*** Include recipe %s:%s\n", recipe.Name, ref.id))
+		expanded.WriteString(includedScript)
+		if !strings.HasSuffix(includedScript, "\n") {
+			expanded.WriteString("\n")
+		}
+		expanded.WriteString(fmt.Sprintf("#*** End of recipe %s:%s\n", recipe.Name, ref.id))
+	}
+	return expanded.String(), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+// inputNameRegexp matches names usable as shell variables
+var inputNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// applicationInputs merges inputs of env file with inputs attribute, inputs attribute taking precedence
+func applicationInputs(envFile string, rawInputs map[string]interface{}) (map[string]string, error) {
+	inputs := make(map[string]string)
+	if envFile != "" {
+		fileInputs, err := loadEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, val := range fileInputs {
+			inputs[key] = val
+		}
+	}
+	for key, val := range rawInputs {
+		inputs[key] = val.(string)
+	}
+	for key := range inputs {
+		if !inputNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("invalid input name %q, must be a valid shell variable name", key)
+		}
+	}
+	return inputs, nil
+}
+
+// loadEnvFile reads inputs from a JSON, YAML or dotenv file
+//
+// Format is selected from file extension (.json, .yaml/.yml), other files are read as dotenv files.
+// YAML files must be a flat mapping of scalar values.
+func loadEnvFile(envFile string) (map[string]string, error) {
+	dat, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %s", envFile, err)
+	}
+	var inputs map[string]string
+	switch strings.ToLower(filepath.Ext(envFile)) {
+	case ".json":
+		err = json.Unmarshal(dat, &inputs)
+	case ".yaml", ".yml":
+		inputs, err = parseKeyValues(dat, ":")
+	default:
+		inputs, err = parseKeyValues(dat, "=")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse env file %s: %s", envFile, err)
+	}
+	return inputs, nil
+}
+
+// parseKeyValues parses lines of key<sep>value, skipping empty lines and comments
+//
+// An optional *export* prefix is allowed, and single or double quotes around values are removed.
+func parseKeyValues(dat []byte, sep string) (map[string]string, error) {
+	inputs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	lineNb := 0
+	for scanner.Scan() {
+		lineNb++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		elts := strings.SplitN(line, sep, 2)
+		if len(elts) != 2 {
+			return nil, fmt.Errorf("line %d: expecting key%svalue", lineNb, sep)
+		}
+		key := strings.TrimSpace(elts[0])
+		inputs[key] = parseValue(strings.TrimSpace(elts[1]))
+	}
+	return inputs, scanner.Err()
+}
+
+// parseValue removes trailing comment, then quotes, of a value
+//
+// A # in a quoted value is kept, text after the closing quote is a comment.
+func parseValue(value string) string {
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			return value[1 : end+1]
+		}
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value
+}
+
+// checkInputs checks that all inputs expected by application are defined
+func checkInputs(app *terraModel.Application, inputs map[string]string) error {
+	missing := make([]string, 0)
+	for key := range app.Inputs {
+		if _, ok := inputs[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	for key := range inputs {
+		if _, ok := app.Inputs[key]; !ok {
+			log.Printf("[WARN] input %s is not an input of application %s", key, app.Name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing inputs for application %s: %s", app.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// shellQuote quotes value for use in a shell script
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// inputsScript exports inputs as environment variables, sorted by name
+func inputsScript(inputs map[string]string) string {
+	keys := make([]string, 0, len(inputs))
+	for key := range inputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	script := ""
+	for _, key := range keys {
+		script += fmt.Sprintf("export %s=%s\n", key, shellQuote(inputs[key]))
+	}
+	return script
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		sep      string
+		expected map[string]string
+		fails    bool
+	}{
+		{"plain", "A=1\nB=two", "=", map[string]string{"A": "1", "B": "two"}, false},
+		{"export prefix", "export A=1", "=", map[string]string{"A": "1"}, false},
+		{"comments and empty lines", "# comment\n\nA=1\n", "=", map[string]string{"A": "1"}, false},
+		{"trailing comment", "A=1 # comment", "=", map[string]string{"A": "1"}, false},
+		{"double quotes", `A="a b"`, "=", map[string]string{"A": "a b"}, false},
+		{"single quotes", `A='a b'`, "=", map[string]string{"A": "a b"}, false},
+		{"quoted with trailing comment", `A="a b" # comment`, "=", map[string]string{"A": "a b"}, false},
+		{"hash in quotes", `A="a #b"`, "=", map[string]string{"A": "a #b"}, false},
+		{"hash in quotes with trailing comment", `A='a #b' # comment`, "=", map[string]string{"A": "a #b"}, false},
+		{"hash without space", "A=a#b", "=", map[string]string{"A": "a#b"}, false},
+		{"value with separator", "A=b=c", "=", map[string]string{"A": "b=c"}, false},
+		{"unterminated quote", `A="a b`, "=", map[string]string{"A": `"a b`}, false},
+		{"yaml", "---\nA: 1\nB: \"x: y\"", ":", map[string]string{"A": "1", "B": "x: y"}, false},
+		{"missing separator", "A", "=", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inputs, err := parseKeyValues([]byte(test.content), test.sep)
+			if test.fails {
+				if err == nil {
+					t.Errorf("parseKeyValues should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseKeyValues failed: %s", err)
+			}
+			if !reflect.DeepEqual(inputs, test.expected) {
+				t.Errorf("parseKeyValues = %v, expected %v", inputs, test.expected)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goterra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file     string
+		content  string
+		expected map[string]string
+		fails    bool
+	}{
+		{"inputs.json", `{"A": "1", "B": "two"}`, map[string]string{"A": "1", "B": "two"}, false},
+		{"inputs.yaml", "A: 1\nB: 'two' # comment\n", map[string]string{"A": "1", "B": "two"}, false},
+		{"inputs.YML", "A: 1\n", map[string]string{"A": "1"}, false},
+		{"inputs.env", "export A=1\nB=\"two\"\n", map[string]string{"A": "1", "B": "two"}, false},
+		{"invalid.json", `{"A": 1}`, nil, true},
+		{"invalid.env", "A\n", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			inputs, err := loadEnvFile(path)
+			if test.fails {
+				if err == nil {
+					t.Errorf("loadEnvFile should fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadEnvFile failed: %s", err)
+			}
+			if !reflect.DeepEqual(inputs, test.expected) {
+				t.Errorf("loadEnvFile = %v, expected %v", inputs, test.expected)
+			}
+		})
+	}
+
+	if _, err := loadEnvFile(filepath.Join(dir, "missing.env")); err == nil {
+		t.Errorf("loadEnvFile should fail on missing file")
+	}
+}
+
+func TestCheckInputs(t *testing.T) {
+	app := &terraModel.Application{Name: "app", Inputs: map[string]string{"A": "", "B": ""}}
+	tests := []struct {
+		name   string
+		inputs map[string]string
+		err    string
+	}{
+		{"all inputs", map[string]string{"A": "1", "B": "2"}, ""},
+		{"extra input", map[string]string{"A": "1", "B": "2", "C": "3"}, ""},
+		{"missing input", map[string]string{"A": "1"}, "missing inputs for application app: B"},
+		{"missing inputs sorted", map[string]string{}, "missing inputs for application app: A, B"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkInputs(app, test.inputs)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("checkInputs failed: %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Errorf("checkInputs error = %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// interpolationRegexp matches escaped references ($${) and variable references (${NAME})
+var interpolationRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Interpolator replaces ${NAME} references with variable values
+//
+// Text is processed in a single pass, so values are never interpolated themselves.
+// $${ is an escape for a literal ${, other unknown references are kept as is,
+// as they are likely shell variables, unknown ${GOT_*} references are recorded as unresolved.
+type Interpolator struct {
+	vars       map[string]string
+	unresolved map[string]bool
+}
+
+func newInterpolator(vars map[string]string) *Interpolator {
+	return &Interpolator{vars: vars, unresolved: make(map[string]bool)}
+}
+
+// extend returns an interpolator with additional variables, recording unresolved references with i
+func (i *Interpolator) extend(vars map[string]string) *Interpolator {
+	merged := make(map[string]string, len(i.vars)+len(vars))
+	for key, val := range i.vars {
+		merged[key] = val
+	}
+	for key, val := range vars {
+		merged[key] = val
+	}
+	return &Interpolator{vars: merged, unresolved: i.unresolved}
+}
+
+// Interpolate returns text with variable references replaced
+func (i *Interpolator) Interpolate(text string) string {
+	return interpolationRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		name := match[2 : len(match)-1]
+		if value, ok := i.vars[name]; ok {
+			return value
+		}
+		if strings.HasPrefix(name, "GOT_") {
+			i.unresolved[name] = true
+		}
+		return match
+	})
+}
+
+// Unresolved returns the sorted unknown ${GOT_*} references met so far
+func (i *Interpolator) Unresolved() []string {
+	names := make([]string, 0, len(i.unresolved))
+	for name := range i.unresolved {
+		names = append(names, "${"+name+"}")
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{
+		"GOT_NAME": "myapp",
+		"USER_VAR": "value",
+		"GOT_REF":  "${GOT_NAME}",
+	}
+	tests := []struct {
+		name       string
+		text       string
+		expected   string
+		unresolved string
+	}{
+		{"variable", "name=${GOT_NAME}", "name=myapp", ""},
+		{"user variable", "${USER_VAR}-${GOT_NAME}", "value-myapp", ""},
+		{"escape", "echo $${GOT_NAME} ${GOT_NAME}", "echo ${GOT_NAME} myapp", ""},
+		{"escaped shell variable", "$${HOME}", "${HOME}", ""},
+		{"value not interpolated", "${GOT_REF}", "${GOT_NAME}", ""},
+		{"shell variable kept", "echo ${HOME} $HOSTNAME", "echo ${HOME} $HOSTNAME", ""},
+		{"shell expansion kept", "${GOT_RECIPE:+:x} ${1}", "${GOT_RECIPE:+:x} ${1}", ""},
+		{"unresolved", "${GOT_FOO} ${GOT_BAR} ${GOT_FOO}", "${GOT_FOO} ${GOT_BAR} ${GOT_FOO}", "${GOT_BAR},${GOT_FOO}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			interpolator := newInterpolator(vars)
+			result := interpolator.Interpolate(test.text)
+			if result != test.expected {
+				t.Errorf("Interpolate(%q) = %q, expected %q", test.text, result, test.expected)
+			}
+			unresolved := strings.Join(interpolator.Unresolved(), ",")
+			if unresolved != test.unresolved {
+				t.Errorf("Unresolved() = %q, expected %q", unresolved, test.unresolved)
+			}
+		})
+	}
+}
+
+func TestInterpolatorExtend(t *testing.T) {
+	interpolator := newInterpolator(map[string]string{"GOT_NAME": "myapp"})
+	extended := interpolator.extend(map[string]string{"HOSTNAME": "web", "GOT_NAME": "other"})
+
+	if result := interpolator.Interpolate("${HOSTNAME} ${GOT_NAME}"); result != "${HOSTNAME} myapp" {
+		t.Errorf("base interpolator got extended variables: %q", result)
+	}
+	if result := extended.Interpolate("${HOSTNAME} ${GOT_NAME}"); result != "web other" {
+		t.Errorf("extended interpolator result %q", result)
+	}
+	extended.Interpolate("${GOT_FOO}")
+	if unresolved := strings.Join(interpolator.Unresolved(), ","); unresolved != "${GOT_FOO}" {
+		t.Errorf("unresolved references of extended interpolator not recorded, got %q", unresolved)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// RecipePolicy is the timeout, in seconds, and number of retries of a recipe, 0 meaning none
+//
+// recipe is a recipe name or id, empty for application defaults.
+// In recipe_policy blocks, policyUnset values do not override recipe or application values.
+type RecipePolicy struct {
+	recipe  string
+	timeout int
+	retries int
+}
+
+// policyUnset is the value of recipe_policy timeout and retries when not set
+const policyUnset = -1
+
+// timeoutDirectiveRegexp matches timeout directive lines of recipe scripts
+var timeoutDirectiveRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*goterra:timeout[ \t]+([0-9]+)[ \t]*\r?$`)
+
+// retriesDirectiveRegexp matches retries directive lines of recipe scripts
+var retriesDirectiveRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*goterra:retries[ \t]+([0-9]+)[ \t]*\r?$`)
+
+// directiveValue returns the value of first directive matching regexp in script
+func directiveValue(directive *regexp.Regexp, script string) (int, bool) {
+	match := directive.FindStringSubmatch(script)
+	if match == nil {
+		return 0, false
+	}
+	value, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// recipePolicy returns timeout and retries of a recipe
+//
+// recipe_policy blocks matching recipe name or id take precedence over
+// `# goterra:timeout <seconds>` and `# goterra:retries <count>` recipe directives,
+// which take precedence over application timeout and retries.
+// Directives are read from recipe own script, not from included recipes.
+func recipePolicy(options ApplicationOptions, recipe ResolvedRecipe) RecipePolicy {
+	policy := RecipePolicy{recipe: recipe.name, timeout: options.timeout, retries: options.retries}
+	if timeout, ok := directiveValue(timeoutDirectiveRegexp, recipe.rawScript); ok {
+		policy.timeout = timeout
+	}
+	if retries, ok := directiveValue(retriesDirectiveRegexp, recipe.rawScript); ok {
+		policy.retries = retries
+	}
+	for _, recipePolicy := range options.recipePolicies {
+		if recipePolicy.recipe == recipe.name || recipePolicy.recipe == recipe.id {
+			if recipePolicy.timeout != policyUnset {
+				policy.timeout = recipePolicy.timeout
+			}
+			if recipePolicy.retries != policyUnset {
+				policy.retries = recipePolicy.retries
+			}
+		}
+	}
+	return policy
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecipePolicy(t *testing.T) {
+	recipe := ResolvedRecipe{id: "5d9f0e4c", name: "base-docker", rawScript: "#!/bin/bash\n# goterra:timeout 600\necho ok\n"}
+	tests := []struct {
+		name     string
+		policies []RecipePolicy
+		timeout  int
+		retries  int
+	}{
+		{"directive over defaults", nil, 600, 1},
+		{"policy by name", []RecipePolicy{{recipe: "base-docker", timeout: 900, retries: 3}}, 900, 3},
+		{"policy by id", []RecipePolicy{{recipe: "5d9f0e4c", timeout: 0, retries: 0}}, 0, 0},
+		{"other recipe policy", []RecipePolicy{{recipe: "other", timeout: 900, retries: 3}}, 600, 1},
+		{"unset timeout", []RecipePolicy{{recipe: "base-docker", timeout: policyUnset, retries: 3}}, 600, 3},
+		{"unset retries", []RecipePolicy{{recipe: "base-docker", timeout: 900, retries: policyUnset}}, 900, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := ApplicationOptions{timeout: 300, retries: 1, recipePolicies: test.policies}
+			policy := recipePolicy(options, recipe)
+			if policy.timeout != test.timeout || policy.retries != test.retries {
+				t.Errorf("recipePolicy = %d, %d, expected %d, %d", policy.timeout, policy.retries, test.timeout, test.retries)
+			}
+		})
+	}
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 
 	"github.com/hashicorp/terraform/helper/schema"
+	"golang.org/x/crypto/ed25519"
 )
 
 // ProviderConfig is the provider base configuration
 type ProviderConfig struct {
-	Address string
-	APIKey  string
+	Address    string
+	APIKey     string
+	CLIVersion string
+	CLIURL     string
+	CLISHA256  string
+	CLIOS      string
+	CLIArch    string
+
+	trustedKeys []ed25519.PublicKey
+
+	recipes  *RecipeCache
+	sessions *SessionCache
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
@@ -19,9 +31,33 @@ func providerConfigure(d *schema.ResourceData) (interface{}, error) {
 		return nil, fmt.Errorf("address or apikey are not defined")
 	}
 	config := ProviderConfig{Address: d.Get("address").(string), APIKey: d.Get("apikey").(string)}
+	config.CLIVersion = d.Get("cli_version").(string)
+	config.CLIURL = d.Get("cli_url").(string)
+	config.CLISHA256 = d.Get("cli_sha256").(string)
+	config.CLIOS = d.Get("cli_os").(string)
+	config.CLIArch = d.Get("cli_arch").(string)
+	trustedKeys, err := parseTrustedKeys(d.Get("trusted_keys").([]interface{}))
+	if err != nil {
+		return nil, err
+	}
+	config.trustedKeys = trustedKeys
+	config.recipes = newRecipeCache()
+	config.sessions = newSessionCache()
 	return config, nil
 }
 
+// validateSHA256 checks value is an hex encoded sha256 checksum
+func validateSHA256(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value == "" {
+		return
+	}
+	if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != 32 {
+		errors = append(errors, fmt.Errorf("%q must be an hex encoded sha256 checksum", k))
+	}
+	return
+}
+
 // Provider is a Terraform provider to manage goterra resources
 func Provider() *schema.Provider {
 	return &schema.Provider{
@@ -36,6 +72,40 @@ func Provider() *schema.Provider {
 				Required:    true,
 				Description: "User API Key",
 			},
+			"cli_version": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "goterra-cli release to install on hosts, latest release if empty",
+			},
+			"cli_url": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "goterra-cli download url template, {version}, {os} and {arch} are replaced by cli_version, cli_os and cli_arch",
+			},
+			"cli_sha256": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Expected sha256 checksum of goterra-cli binary",
+				ValidateFunc: validateSHA256,
+			},
+			"cli_os": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Host operating system (linux, ...), detected on host if empty",
+			},
+			"cli_arch": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Host architecture (amd64, arm64, ...), detected on host if empty",
+			},
+			"trusted_keys": {
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional:    true,
+				Description: "Base64 encoded ed25519 public keys, server recipes must be signed by one of them if set",
+			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
 			"goterra_deployment":  resourceDeployment(),
@@ -44,6 +114,8 @@ func Provider() *schema.Provider {
 		},
 		DataSourcesMap: map[string]*schema.Resource{
 			"goterra_deployment": dataSourceDeployment(),
+			"goterra_cloudinit":  dataSourceCloudinit(),
+			"goterra_logs":       dataSourceLogs(),
 		},
 		ConfigureFunc: providerConfigure,
 	}
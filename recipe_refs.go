@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+// recipeIDRegexp matches goterra recipe ids
+var recipeIDRegexp = regexp.MustCompile(`^[0-9a-fA-F]{24}$`)
+
+// recipeVersionRegexp matches recipe version, a prefix of recipe script sha256
+var recipeVersionRegexp = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// RecipeRef is a server recipe id and the namespace to fetch it from
+type RecipeRef struct {
+	namespace string
+	id        string
+}
+
+// recipeVersion returns the version of a recipe, sha256 of its script
+func recipeVersion(recipe terraModel.Recipe) string {
+	checksum := sha256.Sum256([]byte(recipe.Script))
+	return hex.EncodeToString(checksum[:])
+}
+
+// parseRecipeRef splits a recipe reference [namespace/]name[@version]
+func parseRecipeRef(defaultNamespace string, ref string) (namespace string, name string, version string, err error) {
+	namespace = defaultNamespace
+	name = ref
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		version = strings.ToLower(name[idx+1:])
+		name = name[:idx]
+		if !recipeVersionRegexp.MatchString(version) {
+			return "", "", "", fmt.Errorf("invalid recipe reference %s, version must be a prefix of recipe sha256", ref)
+		}
+	}
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		namespace = name[:idx]
+		name = name[idx+1:]
+	}
+	if namespace == "" || name == "" {
+		return "", "", "", fmt.Errorf("invalid recipe reference %s, expecting [namespace/]name[@version]", ref)
+	}
+	return namespace, name, version, nil
+}
+
+// recipeRefResolver resolves recipe references, listing each namespace recipes once
+type recipeRefResolver struct {
+	options          ApplicationOptions
+	namespaceRecipes map[string][]terraModel.Recipe
+}
+
+func newRecipeRefResolver(options ApplicationOptions) *recipeRefResolver {
+	return &recipeRefResolver{options: options, namespaceRecipes: make(map[string][]terraModel.Recipe)}
+}
+
+// resolve converts recipe references to recipe ids and namespaces
+//
+// A reference is a recipe id, or [namespace/]name[@version], namespace defaulting to defaultNamespace
+// and version being a prefix of the sha256 of recipe script.
+// Names are looked for in namespace recipes. A name matching several recipes, or a version
+// not matching the server recipe, is an error.
+// Empty references give an empty RecipeRef.
+func (r *recipeRefResolver) resolve(defaultNamespace string, refs []string) ([]RecipeRef, error) {
+	resolved := make([]RecipeRef, len(refs))
+	for i, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		if recipeIDRegexp.MatchString(ref) {
+			resolved[i] = RecipeRef{namespace: defaultNamespace, id: ref}
+			continue
+		}
+		namespace, name, version, err := parseRecipeRef(defaultNamespace, ref)
+		if err != nil {
+			return nil, err
+		}
+		recipes, ok := r.namespaceRecipes[namespace]
+		if !ok {
+			recipes, err = listRecipes(r.options, namespace)
+			if err != nil {
+				return nil, err
+			}
+			r.namespaceRecipes[namespace] = recipes
+		}
+		matches := make([]terraModel.Recipe, 0)
+		versions := make([]string, 0)
+		for _, recipe := range recipes {
+			if recipe.Name != name {
+				continue
+			}
+			versions = append(versions, recipeVersion(recipe))
+			if version == "" || strings.HasPrefix(recipeVersion(recipe), version) {
+				matches = append(matches, recipe)
+			}
+		}
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("recipe %s not found in namespace %s", name, namespace)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("recipe %s does not match server version of %s/%s (%s)", ref, namespace, name, strings.Join(versions, ", "))
+		}
+		if len(matches) > 1 {
+			ids := make([]string, len(matches))
+			for j, match := range matches {
+				ids[j] = fmt.Sprintf("%s@%s", match.ID.Hex(), recipeVersion(match))
+			}
+			return nil, fmt.Errorf("recipe %s is ambiguous, matching %s", ref, strings.Join(ids, ", "))
+		}
+		log.Printf("[INFO] recipe %s resolved to %s (version %s)", ref, matches[0].ID.Hex(), recipeVersion(matches[0]))
+		resolved[i] = RecipeRef{namespace: namespace, id: matches[0].ID.Hex()}
+	}
+	return resolved, nil
+}
+
+// listRecipes fetches recipes of namespace from goterra-deploy
+func listRecipes(options ApplicationOptions, namespace string) ([]terraModel.Recipe, error) {
+	log.Printf("[INFO] list recipes of namespace %s", namespace)
+	remote := []string{options.url, "deploy", "ns", namespace, "recipe"}
+	resp, err := deployGet(options, remote)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.url)
+		return nil, fmt.Errorf("[ERROR] failed to list recipes of namespace %s", namespace)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("failed to list recipes %d\n", resp.StatusCode)
+		return nil, fmt.Errorf("[ERROR] failed to list recipes of namespace %s: %d", namespace, resp.StatusCode)
+	}
+	respRecipes := &RespRecipes{}
+	if err := json.NewDecoder(resp.Body).Decode(respRecipes); err != nil {
+		return nil, fmt.Errorf("[ERROR] failed to decode recipes of namespace %s: %s", namespace, err)
+	}
+	return respRecipes.Recipes, nil
+}
+
+// RespRecipes is goterra-deploy namespace recipes answer
+type RespRecipes struct {
+	Recipes []terraModel.Recipe `json:"recipes"`
+}
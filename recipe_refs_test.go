@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRecipeRef(t *testing.T) {
+	tests := []struct {
+		ref       string
+		namespace string
+		name      string
+		version   string
+		fails     bool
+	}{
+		{ref: "base-docker", namespace: "myns", name: "base-docker"},
+		{ref: "shared/base-docker", namespace: "shared", name: "base-docker"},
+		{ref: "base-docker@3f2a9c", namespace: "myns", name: "base-docker", version: "3f2a9c"},
+		{ref: "base-docker@3F2A9C", namespace: "myns", name: "base-docker", version: "3f2a9c"},
+		{ref: "shared/base-docker@3f2a9c", namespace: "shared", name: "base-docker", version: "3f2a9c"},
+		{ref: "base-docker@", fails: true},
+		{ref: "base-docker@v1.0", fails: true},
+		{ref: "/base-docker", fails: true},
+		{ref: "shared/", fails: true},
+		{ref: "@3f2a9c", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			namespace, name, version, err := parseRecipeRef("myns", test.ref)
+			if test.fails {
+				if err == nil {
+					t.Errorf("parseRecipeRef(%q) should fail", test.ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecipeRef(%q) failed: %s", test.ref, err)
+			}
+			if namespace != test.namespace || name != test.name || version != test.version {
+				t.Errorf("parseRecipeRef(%q) = %q, %q, %q, expected %q, %q, %q", test.ref, namespace, name, version, test.namespace, test.name, test.version)
+			}
+		})
+	}
+}
+
+func TestParseRecipeRefNoDefaultNamespace(t *testing.T) {
+	if _, _, _, err := parseRecipeRef("", "base-docker"); err == nil {
+		t.Errorf("parseRecipeRef without namespace should fail")
+	}
+}
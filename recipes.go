@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+)
+
+// localRecipePrefix prefixes identifiers of local recipes, server recipes are identified by their id
+const localRecipePrefix = "local:"
+
+// LocalRecipe is a recipe read from a local file, not published to goterra-deploy
+//
+// parent is a server recipe reference, see recipeRefResolver.
+type LocalRecipe struct {
+	name   string
+	file   string
+	parent string
+}
+
+// ResolvedRecipe is a server or local recipe to execute
+//
+// namespace is the namespace recipe was fetched from, or application namespace for local recipes.
+// parent id is empty if recipe has no parent.
+// sources are the server recipes composing script, recipe itself and included recipes.
+// rawScript is the recipe script before include expansion.
+type ResolvedRecipe struct {
+	id        string
+	name      string
+	namespace string
+	script    string
+	rawScript string
+	parent    RecipeRef
+	sources   []terraModel.Recipe
+}
+
+// newServerRecipe converts a goterra-deploy recipe fetched from namespace
+//
+// Parent recipe is looked for in the same namespace.
+func newServerRecipe(namespace string, recipe *terraModel.Recipe) *ResolvedRecipe {
+	return &ResolvedRecipe{
+		id:        recipe.ID.Hex(),
+		name:      recipe.Name,
+		namespace: namespace,
+		script:    recipe.Script,
+		rawScript: recipe.Script,
+		parent:    RecipeRef{namespace: namespace, id: recipe.ParentRecipe},
+		sources:   []terraModel.Recipe{*recipe},
+	}
+}
+
+// loadLocalRecipe reads a local recipe script, with its resolved parent
+func loadLocalRecipe(options ApplicationOptions, localRecipe LocalRecipe, parent RecipeRef) (*ResolvedRecipe, error) {
+	dat, err := ioutil.ReadFile(localRecipe.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local recipe %s file %s: %s", localRecipe.name, localRecipe.file, err)
+	}
+	return &ResolvedRecipe{
+		id:        localRecipePrefix + localRecipe.name,
+		name:      localRecipe.name,
+		namespace: options.namespace,
+		script:    string(dat),
+		rawScript: string(dat),
+		parent:    parent,
+		sources:   make([]terraModel.Recipe, 0),
+	}, nil
+}
+
+// recipeResolver orders recipes and their parents, parents first
+type recipeResolver struct {
+	options  ApplicationOptions
+	fetched  map[string]*ResolvedRecipe
+	visiting map[string]bool
+	done     map[string]bool
+	path     []string
+	ordered  []ResolvedRecipe
+}
+
+// resolveRecipes fetches selected recipes and their ancestors, and orders them so that
+// ancestors are executed before their descendants
+//
+// Recipes are selected by reference (see recipeRefResolver). Local recipes are selected
+// after server recipes, their parent is a server recipe.
+// Each recipe is fetched once and appears once in result, a cycle in parents is reported as an error.
+// Include directives of recipe scripts are expanded.
+func resolveRecipes(options ApplicationOptions, recipeRefs []string, localRecipes []LocalRecipe) ([]ResolvedRecipe, error) {
+	resolver := &recipeResolver{
+		options:  options,
+		fetched:  make(map[string]*ResolvedRecipe),
+		visiting: make(map[string]bool),
+		done:     make(map[string]bool),
+		path:     make([]string, 0),
+		ordered:  make([]ResolvedRecipe, 0),
+	}
+	parentRefs := make([]string, len(localRecipes))
+	for i, localRecipe := range localRecipes {
+		parentRefs[i] = localRecipe.parent
+	}
+	refResolver := newRecipeRefResolver(options)
+	refs, err := refResolver.resolve(options.namespace, append(append([]string{}, recipeRefs...), parentRefs...))
+	if err != nil {
+		return nil, err
+	}
+	selected := refs[:len(recipeRefs)]
+	pending := make([]RecipeRef, 0, len(refs))
+	pending = append(pending, selected...)
+	for i, localRecipe := range localRecipes {
+		parent := refs[len(recipeRefs)+i]
+		recipe, err := loadLocalRecipe(options, localRecipe, parent)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := resolver.fetched[recipe.id]; ok {
+			return nil, fmt.Errorf("local recipe %s is defined more than once", localRecipe.name)
+		}
+		resolver.fetched[recipe.id] = recipe
+		selected = append(selected, RecipeRef{id: recipe.id})
+		if parent.id != "" {
+			pending = append(pending, parent)
+		}
+	}
+	if err := resolver.prefetch(pending); err != nil {
+		return nil, err
+	}
+	for _, ref := range selected {
+		if err := resolver.visit(ref); err != nil {
+			return nil, err
+		}
+	}
+	for i := range resolver.ordered {
+		if err := expandIncludes(options, refResolver, &resolver.ordered[i]); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("[INFO] resolved recipes %s", strings.Join(recipeNames(resolver.ordered), ", "))
+	return resolver.ordered, nil
+}
+
+// fetch gets a server recipe from cache or goterra-deploy
+func (r *recipeResolver) fetch(ref RecipeRef) (*ResolvedRecipe, error) {
+	nsOptions := r.options
+	nsOptions.namespace = ref.namespace
+	recipe, err := r.options.cache.get(nsOptions, ref.id)
+	if err != nil {
+		return nil, err
+	}
+	return newServerRecipe(ref.namespace, recipe), nil
+}
+
+// prefetch fetches recipes and their ancestors concurrently, one generation at a time
+func (r *recipeResolver) prefetch(refs []RecipeRef) error {
+	var mutex sync.Mutex
+	pending := refs
+	for len(pending) > 0 {
+		next := make([]RecipeRef, 0)
+		err := runConcurrently(len(pending), func(i int) error {
+			ref := pending[i]
+			mutex.Lock()
+			_, ok := r.fetched[ref.id]
+			mutex.Unlock()
+			if ok {
+				return nil
+			}
+			recipe, err := r.fetch(ref)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			r.fetched[ref.id] = recipe
+			if recipe.parent.id != "" {
+				if _, ok := r.fetched[recipe.parent.id]; !ok {
+					next = append(next, recipe.parent)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		pending = next
+	}
+	return nil
+}
+
+func (r *recipeResolver) visit(ref RecipeRef) error {
+	recipeID := ref.id
+	if r.done[recipeID] {
+		return nil
+	}
+	if r.visiting[recipeID] {
+		cycle := make([]string, 0, len(r.path)+1)
+		for _, pathID := range append(r.path, recipeID) {
+			cycle = append(cycle, fmt.Sprintf("%s:%s", r.fetched[pathID].name, pathID))
+		}
+		return fmt.Errorf("recipe cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+	recipe, ok := r.fetched[recipeID]
+	if !ok {
+		var err error
+		recipe, err = r.fetch(ref)
+		if err != nil {
+			return err
+		}
+		r.fetched[recipeID] = recipe
+	}
+	r.visiting[recipeID] = true
+	r.path = append(r.path, recipeID)
+	if recipe.parent.id != "" {
+		if err := r.visit(recipe.parent); err != nil {
+			return err
+		}
+	}
+	r.path = r.path[:len(r.path)-1]
+	r.visiting[recipeID] = false
+	r.done[recipeID] = true
+	r.ordered = append(r.ordered, *recipe)
+	return nil
+}
+
+// recipeNames returns name:id of recipes, for logs
+func recipeNames(recipes []ResolvedRecipe) []string {
+	names := make([]string, len(recipes))
+	for i, recipe := range recipes {
+		names[i] = fmt.Sprintf("%s:%s", recipe.name, recipe.id)
+	}
+	return names
+}
+
+func getRecipe(options ApplicationOptions, recipeID string) (recipe *terraModel.Recipe, err error) {
+	log.Printf("[INFO] load recipe %s", recipeID)
+	remote := []string{options.url, "deploy", "ns", options.namespace, "recipe", recipeID}
+	resp, err := deployGet(options, remote)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.url)
+		return nil, fmt.Errorf("Failed to get recipe %s", recipeID)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("failed to create deployment %d\n", resp.StatusCode)
+		return nil, fmt.Errorf("Failed to get recipe %s", recipeID)
+	}
+	resprecipe := &RespRecipe{}
+	json.NewDecoder(resp.Body).Decode(resprecipe)
+	log.Printf("[DEBUG] fetched recipe %s", resprecipe.Recipe.Name)
+	recipe = &resprecipe.Recipe
+	return recipe, nil
+}
+
+// RespRecipe is goterra-deploy recipe answer
+type RespRecipe struct {
+	Recipe terraModel.Recipe `json:"recipe"`
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newTestResolver returns a resolver with recipes already fetched, recipes being id:parent id pairs
+func newTestResolver(recipes map[string]string) *recipeResolver {
+	fetched := make(map[string]*ResolvedRecipe)
+	for id, parent := range recipes {
+		fetched[id] = &ResolvedRecipe{
+			id:     id,
+			name:   "recipe-" + id,
+			parent: RecipeRef{namespace: "myns", id: parent},
+		}
+	}
+	return &recipeResolver{
+		fetched:  fetched,
+		visiting: make(map[string]bool),
+		done:     make(map[string]bool),
+		path:     make([]string, 0),
+		ordered:  make([]ResolvedRecipe, 0),
+	}
+}
+
+func TestRecipeResolverVisit(t *testing.T) {
+	tests := []struct {
+		name     string
+		recipes  map[string]string
+		selected []string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "no parent",
+			recipes:  map[string]string{"a": "", "b": ""},
+			selected: []string{"b", "a"},
+			expected: []string{"b", "a"},
+		},
+		{
+			name:     "grandparent chain",
+			recipes:  map[string]string{"c": "b", "b": "a", "a": ""},
+			selected: []string{"c"},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name:     "ancestor selected after descendant",
+			recipes:  map[string]string{"c": "b", "b": "a", "a": ""},
+			selected: []string{"c", "a", "b"},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			name:     "diamond",
+			recipes:  map[string]string{"left": "base", "right": "base", "base": "root", "root": ""},
+			selected: []string{"left", "right"},
+			expected: []string{"root", "base", "left", "right"},
+		},
+		{
+			name:     "cycle",
+			recipes:  map[string]string{"a": "b", "b": "a"},
+			selected: []string{"a"},
+			err:      "recipe cycle detected: recipe-a:a -> recipe-b:b -> recipe-a:a",
+		},
+		{
+			name:     "self parent",
+			recipes:  map[string]string{"a": "a"},
+			selected: []string{"a"},
+			err:      "recipe cycle detected: recipe-a:a -> recipe-a:a",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := newTestResolver(test.recipes)
+			var err error
+			for _, id := range test.selected {
+				if err = resolver.visit(RecipeRef{namespace: "myns", id: id}); err != nil {
+					break
+				}
+			}
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("visit error = %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("visit failed: %s", err)
+			}
+			ordered := make([]string, len(resolver.ordered))
+			for i, recipe := range resolver.ordered {
+				ordered[i] = recipe.id
+			}
+			if !reflect.DeepEqual(ordered, test.expected) {
+				t.Errorf("visit order = %v, expected %v", ordered, test.expected)
+			}
+		})
+	}
+}
+
+func TestResolveLocalRecipes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goterra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".sh"), []byte("echo "+name+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	options := ApplicationOptions{namespace: "myns"}
+
+	recipes, err := resolveRecipes(options, []string{}, []LocalRecipe{
+		{name: "first", file: filepath.Join(dir, "first.sh")},
+		{name: "second", file: filepath.Join(dir, "second.sh")},
+	})
+	if err != nil {
+		t.Fatalf("resolveRecipes failed: %s", err)
+	}
+	expected := []string{"first:local:first", "second:local:second"}
+	if names := recipeNames(recipes); !reflect.DeepEqual(names, expected) {
+		t.Errorf("resolveRecipes = %v, expected %v", names, expected)
+	}
+	if recipes[1].script != "echo second\n" {
+		t.Errorf("unexpected script %q", recipes[1].script)
+	}
+
+	_, err = resolveRecipes(options, []string{}, []LocalRecipe{
+		{name: "first", file: filepath.Join(dir, "first.sh")},
+		{name: "first", file: filepath.Join(dir, "second.sh")},
+	})
+	if err == nil || err.Error() != "local recipe first is defined more than once" {
+		t.Errorf("resolveRecipes error = %v, expected duplicate local recipe", err)
+	}
+
+	if _, err := resolveRecipes(options, []string{}, []LocalRecipe{{name: "missing", file: filepath.Join(dir, "missing.sh")}}); err == nil {
+		t.Errorf("resolveRecipes should fail on missing local recipe file")
+	}
+}
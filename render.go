@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RenderedRecipe is a recipe with its script interpolated
+//
+// value is the script as stored in deployment store, under key derived from its checksum.
+// Keys are specific to the application setup (GOT_NAME) so they can be deleted with it.
+// checksum is the sha256 of script without trailing newlines, verified by hosts after download.
+type RenderedRecipe struct {
+	id       string
+	name     string
+	key      string
+	script   string
+	value    string
+	checksum string
+}
+
+// newRenderedRecipe sets recipe store value and key for selected store client
+func newRenderedRecipe(options ApplicationOptions, gotName string, id string, name string, script string) RenderedRecipe {
+	value := script
+	if options.client == clientCurl {
+		value = base64.StdEncoding.EncodeToString([]byte(script))
+	}
+	checksum := sha256.Sum256([]byte(value))
+	scriptChecksum := sha256.Sum256([]byte(strings.TrimRight(script, "\n")))
+	return RenderedRecipe{
+		id:       id,
+		name:     name,
+		key:      fmt.Sprintf("_recipe_%s_%s", gotName, hex.EncodeToString(checksum[:])),
+		script:   script,
+		value:    value,
+		checksum: hex.EncodeToString(scriptChecksum[:]),
+	}
+}
+
+// InstanceOptions defines an application instance and its inputs overrides
+type InstanceOptions struct {
+	name   string
+	inputs map[string]string
+}
+
+// InstanceRendering is the generated script of an application instance
+//
+// userData is the content of cloudinit file, the script itself or, in stub mode,
+// a stub fetching script from bootstrap store key.
+type InstanceRendering struct {
+	gotName   string
+	file      string
+	script    string
+	hash      string
+	userData  string
+	bootstrap *RenderedRecipe
+}
+
+// AppRendering is the generated scripts of application instances and their recipes, not yet published
+type AppRendering struct {
+	gotName   string
+	hash      string
+	resolved  []string
+	recipes   []RenderedRecipe
+	instances []InstanceRendering
+}
+
+// recipeIDs returns the ids of resolved recipes, in execution order
+func (r *AppRendering) recipeIDs() []string {
+	return r.resolved
+}
+
+// gotNames returns the setup names of instances
+func (r *AppRendering) gotNames() []string {
+	names := make([]string, len(r.instances))
+	for i, instance := range r.instances {
+		names[i] = instance.gotName
+	}
+	return names
+}
+
+// files returns the cloudinit file names of instances
+func (r *AppRendering) files() []string {
+	files := make([]string, len(r.instances))
+	for i, instance := range r.instances {
+		files[i] = instance.file
+	}
+	return files
+}
+
+// applicationInstances returns instances to render, from instance blocks or instances count
+//
+// If none is defined, a single unnamed instance is rendered.
+func applicationInstances(options ApplicationOptions) []InstanceOptions {
+	if len(options.instanceSpecs) > 0 {
+		return options.instanceSpecs
+	}
+	if options.instances > 0 {
+		instances := make([]InstanceOptions, options.instances)
+		for i := range instances {
+			instances[i] = InstanceOptions{name: strconv.Itoa(i)}
+		}
+		return instances
+	}
+	return []InstanceOptions{InstanceOptions{}}
+}
+
+// generateGotName generates a setup name from application name and a random suffix
+func generateGotName(appName string) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Printf("[WARN] failed to generate random name suffix: %s", err)
+	}
+	return fmt.Sprintf("%s-%s", setupNameCharRegexp.ReplaceAllString(appName, "-"), hex.EncodeToString(suffix))
+}
+
+// setupNameCharRegexp matches characters not allowed in GOT_NAME, see setupNameRegexp
+var setupNameCharRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// storeEntries returns the rendered recipes and bootstrap scripts to upload to store
+func (r *AppRendering) storeEntries() []RenderedRecipe {
+	entries := make([]RenderedRecipe, 0, len(r.recipes)+len(r.instances))
+	entries = append(entries, r.recipes...)
+	for _, instance := range r.instances {
+		if instance.bootstrap != nil {
+			entries = append(entries, *instance.bootstrap)
+		}
+	}
+	return entries
+}
+
+// recipeKeys returns the store keys of rendered recipes and bootstrap scripts
+func (r *AppRendering) recipeKeys() []string {
+	entries := r.storeEntries()
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	return keys
+}
+
+// renderApp fetches application and recipes and generates the script of each application instance
+//
+// Nothing is written to the store nor to disk.
+func renderApp(options ApplicationOptions) (*AppRendering, error) {
+	app, err := getApplication(options)
+	if err != nil {
+		return nil, err
+	}
+
+	gotName := options.gotName
+	if options.name != "" {
+		gotName = options.name
+	} else if gotName == "" {
+		gotName = generateGotName(app.Name)
+	}
+
+	recipes, err := resolveRecipes(options, options.recipes, options.localRecipes)
+	if err != nil {
+		log.Printf("[ERROR] Failed to resolve recipes: %s", err)
+		return nil, err
+	}
+	if err := verifyRecipes(options, recipes); err != nil {
+		return nil, err
+	}
+
+	rendering := &AppRendering{
+		gotName:   gotName,
+		resolved:  make([]string, len(recipes)),
+		recipes:   make([]RenderedRecipe, 0),
+		instances: make([]InstanceRendering, 0),
+	}
+	for i, recipe := range recipes {
+		rendering.resolved[i] = recipe.id
+	}
+
+	baseFile := options.application
+	if options.name != "" {
+		baseFile = fmt.Sprintf("%s-%s", options.application, options.name)
+	}
+
+	storedRecipes := make(map[string]bool)
+	hashes := make([]string, 0)
+	for index, instance := range applicationInstances(options) {
+		instanceRendering := InstanceRendering{gotName: gotName, file: baseFile + ".sh"}
+		if instance.name != "" {
+			instanceRendering.gotName = fmt.Sprintf("%s-%s", gotName, instance.name)
+			instanceRendering.file = fmt.Sprintf("%s-%s.sh", baseFile, instance.name)
+		}
+		inputs := make(map[string]string)
+		for key, val := range options.inputs {
+			inputs[key] = val
+		}
+		for key, val := range instance.inputs {
+			inputs[key] = val
+		}
+		if err := checkInputs(app, inputs); err != nil {
+			return nil, err
+		}
+
+		vars := map[string]string{
+			"GOT_ID":            options.application,
+			"GOT_URL":           options.deploymentAddress,
+			"GOT_TOKEN":         options.deploymentToken,
+			"GOT_DEP":           options.deployment,
+			"GOT_NAME":          instanceRendering.gotName,
+			"GOT_NAMESPACE":     options.namespace,
+			"GOT_APP":           app.Name,
+			"GOT_INDEX":         strconv.Itoa(index),
+			"GOT_LOG_INTERVAL":  strconv.Itoa(options.logInterval),
+			"GOT_LOG_MAX_BYTES": strconv.Itoa(options.logMaxBytes),
+		}
+		interpolator := newInterpolator(vars)
+		recipeInterpolator := interpolator.extend(options.variables)
+
+		// Only templates and recipes are interpolated, embedded recipes are already interpolated,
+		// inputs and ssh keys are user values kept as is.
+		// User variables are only interpolated in recipes, templates only use GOT_* variables.
+		headerTxt := goterraTmplPre + "\n"
+		headerTxt = strings.Replace(headerTxt, "${GOT_STORE_CLIENT}", storeClientScript(options), -1)
+		headerTxt = strings.Replace(headerTxt, "${GOT_CLI_SETUP}", cliSetupScript(options), -1)
+		scriptTxt := interpolator.Interpolate(headerTxt)
+		scriptTxt += inputsScript(inputs)
+		scriptTxt += sshKeysScript(options.sshKeys)
+
+		for i, recipe := range recipes {
+			renderedRecipe := newRenderedRecipe(options, gotName, recipe.id, recipe.name, recipeInterpolator.Interpolate(recipe.script))
+			scriptTxt += fmt.Sprintf("\n#*** Load recipe %s:%s **********\n", recipe.name, recipe.id)
+			if options.embedRecipes {
+				scriptTxt += embeddedRecipeScript(renderedRecipe, i)
+			} else if !storedRecipes[renderedRecipe.key] {
+				storedRecipes[renderedRecipe.key] = true
+				rendering.recipes = append(rendering.recipes, renderedRecipe)
+			}
+			scriptTxt += interpolator.Interpolate(recipeRunScript(options, renderedRecipe, recipePolicy(options, recipe), i))
+		}
+		if len(recipes) > 0 {
+			scriptTxt += "\n#****************************\n"
+		}
+
+		scriptTxt += "\n" + interpolator.Interpolate(goterraTmpPost)
+		instanceRendering.script = scriptTxt
+		checksum := sha256.Sum256([]byte(instanceRendering.script))
+		instanceRendering.hash = hex.EncodeToString(checksum[:])
+
+		if unresolved := interpolator.Unresolved(); len(unresolved) > 0 {
+			return nil, fmt.Errorf("unresolved variables in application %s: %s", app.Name, strings.Join(unresolved, ", "))
+		}
+
+		instanceRendering.userData = instanceRendering.script
+		if options.bootstrapMode == bootstrapStub {
+			value := base64.StdEncoding.EncodeToString([]byte(instanceRendering.script))
+			instanceRendering.bootstrap = &RenderedRecipe{
+				name:   "bootstrap",
+				key:    fmt.Sprintf("_bootstrap_%s_%s", gotName, instanceRendering.hash),
+				script: instanceRendering.script,
+				value:  value,
+			}
+			vars["GOT_BOOTSTRAP_KEY"] = instanceRendering.bootstrap.key
+			vars["GOT_BOOTSTRAP_SHA256"] = instanceRendering.hash
+			instanceRendering.userData = newInterpolator(vars).Interpolate(goterraStubTmpl)
+		}
+		if options.maxUserDataBytes > 0 && len(instanceRendering.userData) > options.maxUserDataBytes {
+			msg := fmt.Sprintf("user data of %s is %d bytes, more than max_user_data_bytes (%d)", instanceRendering.file, len(instanceRendering.userData), options.maxUserDataBytes)
+			if options.bootstrapMode != bootstrapStub {
+				msg += `, consider using bootstrap_mode = "stub"`
+			}
+			return nil, fmt.Errorf("%s", msg)
+		}
+		rendering.instances = append(rendering.instances, instanceRendering)
+		hashes = append(hashes, instanceRendering.hash)
+	}
+
+	rendering.hash = hashes[0]
+	if len(hashes) > 1 {
+		checksum := sha256.Sum256([]byte(strings.Join(hashes, "\n")))
+		rendering.hash = hex.EncodeToString(checksum[:])
+	}
+	return rendering, nil
+}
@@ -8,86 +8,15 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"regexp"
 	"strings"
-	"time"
 
 	"github.com/hashicorp/terraform/helper/schema"
 
 	terraModel "github.com/osallou/goterra-lib/lib/model"
+	"golang.org/x/crypto/ed25519"
 )
 
-const goterraTmplPre string = `#!/bin/bash
-set -e
-
-export TOKEN="${GOT_TOKEN}"
-
-ON_ERROR () {
-	trap ERR
-	if [ -e /opt/got/${GOT_ID}.log ]; then
-		/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put _log_app_${GOT_NAME}_${HOSTNAME} @/opt/got/${GOT_ID}.log
-	fi
-	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put status_app_${GOT_NAME}_${HOSTNAME} failed
-	exit 1
-}
-
-trap ON_ERROR ERR
-
-export GOT_TRIM=1000000
-
-echo "Set up goterra"
-
-if [ -n "$(command -v yum)" ]; then
-    yum -y install curl dos2unix
-fi
-
-if [ -n "$(command -v apt)" ]; then
-	export DEBIAN_NONINTERACTIVE=1
-	systemctl stop apt-daily.timer || true
-	systemctl disable apt-daily.timer || true
-	systemctl mask apt-daily.service || true
-	systemctl daemon-reload
-	apt-get purge -y unattended-upgrades || true
-	time (while ps -opid= -C apt-get > /dev/null; do sleep 1; done); echo "Waiting for apt unlock"
-    apt-get update && apt-get install -y  curl dos2unix
-fi
-
-get_latest_release() {
-	curl --silent "https://api.github.com/repos/osallou/goterra-store/releases/latest" |
-	  grep '"tag_name":' |
-	  sed -E 's/.*"([^"]+)".*/\1/'
-}
-cliversion=` + "`get_latest_release`" + `
-
-send_start_ts() {
-	cur=` + "`date +%s`" + `
-	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put ts_start_${GOT_NAME}_${HOSTNAME} $cur
-}
-
-send_end_ts() {
-	cur=` + "`date +%s`" + `
-	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put ts_end_${GOT_NAME}_${HOSTNAME} $cur
-}
-
-echo "[INFO] initialization"
-
-mkdir -p /opt/got
-curl -L -o /opt/got/goterra-cli https://github.com/osallou/goterra-store/releases/download/$cliversion/goterra-cli.linux.amd64
-chmod +x /opt/got/goterra-cli
-send_start_ts
-
-/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put status_app_${GOT_NAME}_${HOSTNAME} start
-`
-const goterraTmpPost string = `
-echo "[INFO] setup is over"
-send_end_ts
-/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put status_app_${GOT_NAME}_${HOSTNAME} over
-if [ -e /opt/got/${GOT_ID}.log ]; then
-	/opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN put _log_app_${GOT_NAME}_${HOSTNAME} @/opt/got/${GOT_ID}.log
-fi
-
-`
-
 func resourceApplication() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceApplicationCreate,
@@ -95,10 +24,13 @@ func resourceApplication() *schema.Resource {
 		Update: resourceApplicationUpdate,
 		Delete: resourceApplicationDelete,
 
+		CustomizeDiff: resourceApplicationDiff,
+
 		Schema: map[string]*schema.Schema{
 			"name": &schema.Schema{
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateSetupName,
 			},
 			"address": &schema.Schema{
 				Type:     schema.TypeString,
@@ -122,6 +54,28 @@ func resourceApplication() *schema.Resource {
 				},
 				Optional: true,
 			},
+			"local_recipe": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": &schema.Schema{
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validateRecipeName,
+						},
+						"file": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"parent": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Server recipe reference to execute before this recipe",
+						},
+					},
+				},
+			},
 			"deployment": &schema.Schema{
 				Type:     schema.TypeString,
 				Required: true,
@@ -142,20 +96,225 @@ func resourceApplication() *schema.Resource {
 				Type:     schema.TypeString,
 				Required: true,
 			},
+			"cli_version": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cli_url": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cli_sha256": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateSHA256,
+			},
+			"cli_os": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cli_arch": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"client": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      clientCLI,
+				ValidateFunc: validateClient,
+			},
+			"inputs": &schema.Schema{
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+			},
+			"variables": &schema.Schema{
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+			},
+			"env_file": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"ssh_authorized_keys": sshAuthorizedKeysSchema(),
+			"instances": &schema.Schema{
+				Type:          schema.TypeInt,
+				Optional:      true,
+				Default:       0,
+				ConflictsWith: []string{"instance"},
+			},
+			"instance": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"instances"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": &schema.Schema{
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validateSetupName,
+						},
+						"inputs": &schema.Schema{
+							Type: schema.TypeMap,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+							Optional: true,
+						},
+					},
+				},
+			},
+			"embed_recipes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"bootstrap_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      bootstrapFull,
+				ValidateFunc: validateBootstrapMode,
+			},
+			"max_user_data_bytes": &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+			"timeout": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validatePositiveOrZero,
+				Description:  "Default recipe timeout, in seconds, 0 for no timeout",
+			},
+			"retries": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validatePositiveOrZero,
+				Description:  "Default number of retries of a failed recipe",
+			},
+			"recipe_policy": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"recipe": &schema.Schema{
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Recipe name or id",
+						},
+						"timeout": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      policyUnset,
+							ValidateFunc: validatePolicyValue,
+							Description:  "Recipe timeout, in seconds, 0 for no timeout, unset to keep recipe or application timeout",
+						},
+						"retries": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      policyUnset,
+							ValidateFunc: validatePolicyValue,
+							Description:  "Number of retries of the recipe, unset to keep recipe or application retries",
+						},
+					},
+				},
+			},
+			"log_interval": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      60,
+				ValidateFunc: validatePositiveOrZero,
+				Description:  "Interval, in seconds, between host log uploads, 0 to upload at end of setup only",
+			},
+			"log_max_bytes": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1000000,
+				ValidateFunc: validatePositive,
+				Description:  "Maximum size of uploaded host log, last bytes of log are kept",
+			},
 			"cloudinit": &schema.Schema{
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			"cloudinits": &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+			"got_names": &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+			"got_name": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"script_hash": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"keepers": &schema.Schema{
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				ForceNew: true,
+			},
+			"retain_host_keys": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"delete_superseded_keys": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"recipe_keys": &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+			"resolved_recipes": &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
 		},
 	}
 }
 
-func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
+// resourceGetter gives access to resource attributes, at plan or apply time
+type resourceGetter interface {
+	Get(key string) interface{}
+}
+
+// applicationOptions sets application options from resource and provider configuration
+func applicationOptions(d resourceGetter, m interface{}) (ApplicationOptions, error) {
 	address := d.Get("address").(string)
 	apikey := d.Get("apikey").(string)
 
 	options := ApplicationOptions{}
 	options.name = d.Get("name").(string)
+	options.gotName = d.Get("got_name").(string)
 	rawRecipeTags := d.Get("recipe_tags").([]interface{})
 	options.recipeTags = make([]string, len(rawRecipeTags))
 	for i, raw := range rawRecipeTags {
@@ -168,6 +327,16 @@ func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
 		options.recipes[i] = raw.(string)
 	}
 
+	options.localRecipes = make([]LocalRecipe, 0)
+	for _, rawLocalRecipe := range d.Get("local_recipe").([]interface{}) {
+		localRecipe := rawLocalRecipe.(map[string]interface{})
+		options.localRecipes = append(options.localRecipes, LocalRecipe{
+			name:   localRecipe["name"].(string),
+			file:   localRecipe["file"].(string),
+			parent: localRecipe["parent"].(string),
+		})
+	}
+
 	options.url = m.(ProviderConfig).Address
 	options.apikey = m.(ProviderConfig).APIKey
 	if address != "" {
@@ -177,6 +346,32 @@ func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
 		options.apikey = apikey
 	}
 
+	options.cliVersion = m.(ProviderConfig).CLIVersion
+	options.cliURL = m.(ProviderConfig).CLIURL
+	options.cliSHA256 = m.(ProviderConfig).CLISHA256
+	if cliVersion := d.Get("cli_version").(string); cliVersion != "" {
+		options.cliVersion = cliVersion
+	}
+	if cliURL := d.Get("cli_url").(string); cliURL != "" {
+		options.cliURL = cliURL
+	}
+	if cliSHA256 := d.Get("cli_sha256").(string); cliSHA256 != "" {
+		options.cliSHA256 = cliSHA256
+	}
+	options.cliOS = m.(ProviderConfig).CLIOS
+	options.cliArch = m.(ProviderConfig).CLIArch
+	if cliOS := d.Get("cli_os").(string); cliOS != "" {
+		options.cliOS = cliOS
+	}
+	if cliArch := d.Get("cli_arch").(string); cliArch != "" {
+		options.cliArch = cliArch
+	}
+
+	options.cache = m.(ProviderConfig).recipes
+	options.sessions = m.(ProviderConfig).sessions
+	options.trustedKeys = m.(ProviderConfig).trustedKeys
+
+	options.client = d.Get("client").(string)
 	options.deployment = d.Get("deployment").(string)
 	options.application = d.Get("application").(string)
 	options.namespace = d.Get("namespace").(string)
@@ -185,17 +380,141 @@ func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
 	if options.deploymentAddress == "" {
 		options.deploymentAddress = options.url
 	}
-	cloudinit, err := createApp(options)
+
+	options.sshKeys = sshAuthorizedKeys(d.Get("ssh_authorized_keys").([]interface{}))
+
+	inputs, err := applicationInputs(d.Get("env_file").(string), d.Get("inputs").(map[string]interface{}))
+	if err != nil {
+		return options, err
+	}
+	options.inputs = inputs
+
+	options.embedRecipes = d.Get("embed_recipes").(bool)
+	options.bootstrapMode = d.Get("bootstrap_mode").(string)
+	options.maxUserDataBytes = d.Get("max_user_data_bytes").(int)
+	options.timeout = d.Get("timeout").(int)
+	options.retries = d.Get("retries").(int)
+	options.recipePolicies = make([]RecipePolicy, 0)
+	for _, rawPolicy := range d.Get("recipe_policy").([]interface{}) {
+		policy := rawPolicy.(map[string]interface{})
+		options.recipePolicies = append(options.recipePolicies, RecipePolicy{
+			recipe:  policy["recipe"].(string),
+			timeout: policy["timeout"].(int),
+			retries: policy["retries"].(int),
+		})
+	}
+	options.logInterval = d.Get("log_interval").(int)
+	options.logMaxBytes = d.Get("log_max_bytes").(int)
+
+	options.instances = d.Get("instances").(int)
+	options.instanceSpecs = make([]InstanceOptions, 0)
+	for _, rawInstance := range d.Get("instance").([]interface{}) {
+		instance := rawInstance.(map[string]interface{})
+		instanceOptions := InstanceOptions{name: instance["name"].(string), inputs: make(map[string]string)}
+		for key, val := range instance["inputs"].(map[string]interface{}) {
+			if !inputNameRegexp.MatchString(key) {
+				return options, fmt.Errorf("invalid input name %q, must be a valid shell variable name", key)
+			}
+			instanceOptions.inputs[key] = val.(string)
+		}
+		options.instanceSpecs = append(options.instanceSpecs, instanceOptions)
+	}
+
+	options.variables = make(map[string]string)
+	for key, val := range d.Get("variables").(map[string]interface{}) {
+		if !inputNameRegexp.MatchString(key) || strings.HasPrefix(key, "GOT_") {
+			return options, fmt.Errorf("invalid variable name %q, must be a valid shell variable name, not starting with GOT_", key)
+		}
+		options.variables[key] = val.(string)
+	}
+	return options, nil
+}
+
+// applicationRenderKeys are the attributes used to render application script
+var applicationRenderKeys = []string{
+	"name", "address", "apikey", "recipes", "local_recipe", "deployment", "deployment_token", "deployment_address",
+	"application", "namespace", "cli_version", "cli_url", "cli_sha256", "cli_os", "cli_arch",
+	"client", "inputs", "variables", "env_file", "ssh_authorized_keys", "instances", "instance",
+	"bootstrap_mode", "max_user_data_bytes", "embed_recipes", "log_interval", "log_max_bytes",
+	"timeout", "retries", "recipe_policy",
+}
+
+// recipeNameRegexp matches names usable in store keys and file names
+var recipeNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateRecipeName checks local recipe name can be used in store keys and file names
+func validateRecipeName(v interface{}, k string) (ws []string, errors []error) {
+	if !recipeNameRegexp.MatchString(v.(string)) {
+		errors = append(errors, fmt.Errorf("%q must only contain letters, digits, '_', '.' or '-'", k))
+	}
+	return
+}
+
+// setupNameRegexp matches names usable in GOT_NAME
+//
+// '_' is not allowed, it separates GOT_NAME from host name in host keys.
+var setupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// validateSetupName checks setup or instance name can be used in GOT_NAME, store keys and file names
+func validateSetupName(v interface{}, k string) (ws []string, errors []error) {
+	if !setupNameRegexp.MatchString(v.(string)) {
+		errors = append(errors, fmt.Errorf("%q must only contain letters, digits, '.' or '-'", k))
+	}
+	return
+}
+
+// validatePositive checks an integer attribute is strictly positive
+func validatePositive(v interface{}, k string) (ws []string, errors []error) {
+	if v.(int) <= 0 {
+		errors = append(errors, fmt.Errorf("%q must be positive", k))
+	}
+	return
+}
+
+// validatePositiveOrZero checks an integer attribute is not negative
+func validatePositiveOrZero(v interface{}, k string) (ws []string, errors []error) {
+	if v.(int) < 0 {
+		errors = append(errors, fmt.Errorf("%q must not be negative", k))
+	}
+	return
+}
+
+// validatePolicyValue checks a recipe_policy value is positive, zero, or unset
+func validatePolicyValue(v interface{}, k string) (ws []string, errors []error) {
+	if v.(int) < policyUnset {
+		errors = append(errors, fmt.Errorf("%q must not be negative", k))
+	}
+	return
+}
+
+// setApplicationCloudinit sets resource computed attributes from generated cloudinit
+func setApplicationCloudinit(d *schema.ResourceData, appCloudinit *AppCloudinit) {
+	d.Set("cloudinit", appCloudinit.files[0])
+	d.Set("cloudinits", appCloudinit.files)
+	d.Set("got_names", appCloudinit.gotNames)
+	d.Set("resolved_recipes", appCloudinit.recipes)
+	d.Set("got_name", appCloudinit.gotName)
+	d.Set("script_hash", appCloudinit.hash)
+	d.Set("recipe_keys", appCloudinit.recipeKeys)
+}
+
+func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
+	options, err := applicationOptions(d, m)
+	if err != nil {
+		return err
+	}
+	appCloudinit, err := createApp(options)
 	if err != nil {
 		return err
 	}
+	cloudinit := appCloudinit.files[0]
 
 	id := fmt.Sprintf("%s-%s", options.deployment, options.application)
 	if options.name != "" {
 		id = fmt.Sprintf("%s-%s", id, options.name)
 	}
 	d.SetId(id)
-	d.Set("cloudinit", cloudinit)
+	setApplicationCloudinit(d, appCloudinit)
 	if cloudinit == "" {
 		log.Printf("[ERROR] failed to create cloudinit")
 		return nil
@@ -204,195 +523,339 @@ func resourceApplicationCreate(d *schema.ResourceData, m interface{}) error {
 	return resourceServerRead(d, m)
 }
 
+// resourceApplicationDiff renders application script at plan time
+//
+// It reports missing application inputs and unresolved variables in recipes,
+// and sets the new script hash so that plan shows when script changes.
+// On creation, if name is not set, GOT_NAME is generated on apply, attributes depending on it
+// are then only known after apply.
+func resourceApplicationDiff(d *schema.ResourceDiff, m interface{}) error {
+	for _, key := range applicationRenderKeys {
+		if !d.NewValueKnown(key) {
+			log.Printf("[DEBUG] %s not known yet, skipping render", key)
+			if err := d.SetNewComputed("recipe_keys"); err != nil {
+				return err
+			}
+			return d.SetNewComputed("script_hash")
+		}
+	}
+	options, err := applicationOptions(d, m)
+	if err != nil {
+		return err
+	}
+	rendering, err := renderApp(options)
+	if err != nil {
+		return err
+	}
+	if d.Id() == "" && options.name == "" {
+		for _, key := range []string{"got_name", "got_names", "script_hash", "recipe_keys"} {
+			if err := d.SetNewComputed(key); err != nil {
+				return err
+			}
+		}
+		if err := d.SetNew("resolved_recipes", rendering.recipeIDs()); err != nil {
+			return err
+		}
+		if err := d.SetNew("cloudinit", rendering.files()[0]); err != nil {
+			return err
+		}
+		return d.SetNew("cloudinits", rendering.files())
+	}
+	if d.Get("got_name").(string) != rendering.gotName {
+		if err := d.SetNew("got_name", rendering.gotName); err != nil {
+			return err
+		}
+	}
+	if d.Get("script_hash").(string) != rendering.hash {
+		if err := d.SetNew("script_hash", rendering.hash); err != nil {
+			return err
+		}
+		if err := d.SetNew("resolved_recipes", rendering.recipeIDs()); err != nil {
+			return err
+		}
+		// keys are derived from recipe content, set on apply
+		if err := d.SetNewComputed("recipe_keys"); err != nil {
+			return err
+		}
+	} else if d.HasChange("delete_superseded_keys") {
+		// superseded keys, kept in recipe_keys, may be deleted on apply
+		if err := d.SetNewComputed("recipe_keys"); err != nil {
+			return err
+		}
+	}
+	if !stringListEquals(d.Get("got_names").([]interface{}), rendering.gotNames()) {
+		if err := d.SetNew("got_names", rendering.gotNames()); err != nil {
+			return err
+		}
+	}
+	if !stringListEquals(d.Get("cloudinits").([]interface{}), rendering.files()) {
+		if err := d.SetNew("cloudinit", rendering.files()[0]); err != nil {
+			return err
+		}
+		if err := d.SetNew("cloudinits", rendering.files()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func resourceApplicationRead(d *schema.ResourceData, m interface{}) error {
 	return nil
 }
 
+// resourceApplicationUpdate renders and publishes application script again
 func resourceApplicationUpdate(d *schema.ResourceData, m interface{}) error {
-	return resourceServerRead(d, m)
+	options, err := applicationOptions(d, m)
+	if err != nil {
+		return err
+	}
+	appCloudinit, err := createApp(options)
+	if err != nil {
+		return err
+	}
+	usedFiles := make(map[string]bool)
+	for _, file := range appCloudinit.files {
+		usedFiles[file] = true
+	}
+	for _, previous := range applicationFiles(d) {
+		if usedFiles[previous] {
+			continue
+		}
+		if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] failed to remove previous cloudinit file %s: %s", previous, err)
+		}
+	}
+
+	// Keys of previous script may still be fetched by hosts booted with it, they are kept,
+	// and deleted on destroy, unless delete_superseded_keys is set
+	previousOptions := ApplicationOptions{}
+	oldURL, _ := d.GetChange("address")
+	oldDeployment, _ := d.GetChange("deployment")
+	oldToken, _ := d.GetChange("deployment_token")
+	oldAddress, _ := d.GetChange("deployment_address")
+	oldKeys, _ := d.GetChange("recipe_keys")
+	previousOptions.url = m.(ProviderConfig).Address
+	if oldURL.(string) != "" {
+		previousOptions.url = oldURL.(string)
+	}
+	previousOptions.deployment = oldDeployment.(string)
+	previousOptions.deploymentToken = oldToken.(string)
+	previousOptions.deploymentAddress = oldAddress.(string)
+	if previousOptions.deploymentAddress == "" {
+		previousOptions.deploymentAddress = previousOptions.url
+	}
+	sameStore := previousOptions.deployment == options.deployment && previousOptions.deploymentAddress == options.deploymentAddress
+	usedKeys := make(map[string]bool)
+	if sameStore {
+		for _, key := range appCloudinit.recipeKeys {
+			usedKeys[key] = true
+		}
+	}
+	staleKeys := make([]string, 0)
+	for _, key := range oldKeys.([]interface{}) {
+		if !usedKeys[key.(string)] {
+			staleKeys = append(staleKeys, key.(string))
+		}
+	}
+	if d.Get("delete_superseded_keys").(bool) {
+		deleteStoreKeys(previousOptions, staleKeys)
+	} else if sameStore {
+		appCloudinit.recipeKeys = append(appCloudinit.recipeKeys, staleKeys...)
+	} else if len(staleKeys) > 0 {
+		log.Printf("[INFO] keeping %d keys of previous deployment %s", len(staleKeys), previousOptions.deployment)
+	}
+
+	setApplicationCloudinit(d, appCloudinit)
+	log.Printf("[INFO] Cloudinit files: %s\n", strings.Join(appCloudinit.files, ", "))
+	return resourceApplicationRead(d, m)
 }
 
+// resourceApplicationDelete removes cloudinit file and application keys from deployment store
+//
+// Host status, timestamps and logs keys are kept if retain_host_keys is set.
+// Failures are logged but do not prevent resource deletion.
 func resourceApplicationDelete(d *schema.ResourceData, m interface{}) error {
+	for _, cloudinit := range applicationFiles(d) {
+		if err := os.Remove(cloudinit); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] failed to remove cloudinit file %s: %s", cloudinit, err)
+		}
+	}
+
+	options := applicationStoreOptions(d, m)
+	keys := make([]string, 0)
+	for _, key := range d.Get("recipe_keys").([]interface{}) {
+		keys = append(keys, key.(string))
+	}
+
+	gotNames := make([]string, 0)
+	for _, gotName := range d.Get("got_names").([]interface{}) {
+		gotNames = append(gotNames, gotName.(string))
+	}
+	if len(gotNames) == 0 && d.Get("got_name").(string) != "" {
+		gotNames = append(gotNames, d.Get("got_name").(string))
+	}
+	if !d.Get("retain_host_keys").(bool) && len(gotNames) > 0 {
+		storeKeys, err := listStoreKeys(options)
+		if err != nil {
+			log.Printf("[WARN] failed to list deployment keys: %s", err)
+		}
+		for _, key := range storeKeys {
+			for _, gotName := range gotNames {
+				if isHostKey(key, gotName) {
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+	}
+	deleteStoreKeys(options, keys)
 	return nil
 }
 
-// DeployToken is deploy bind answer
-type DeployToken struct {
-	Token string `json:"token"`
+// hostKeyPrefixes are the prefixes of keys set by hosts, followed by GOT_NAME and host name
+var hostKeyPrefixes = []string{"status_app_", "status_recipe_", "ts_start_", "ts_end_", "_log_app_"}
+
+// isHostKey checks if key is set by a host of application setup gotName
+//
+// GOT_NAME does not contain '_', so keys of a setup whose name starts with gotName do not match.
+func isHostKey(key string, gotName string) bool {
+	for _, prefix := range hostKeyPrefixes {
+		if strings.HasPrefix(key, prefix+gotName+"_") {
+			return true
+		}
+	}
+	return false
 }
 
-func createApp(options ApplicationOptions) (string, error) {
-	cloudinit := ""
-	client := &http.Client{}
-	remote := []string{options.url, "deploy", "session", "bind"}
-	byteData := make([]byte, 0)
-	req, _ := http.NewRequest("POST", strings.Join(remote, "/"), bytes.NewReader(byteData))
-	req.Header.Add("X-API-Key", options.apikey)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to contact server %s\n", options.url)
-		return "", fmt.Errorf("[ERROR] failed to contact server %s", options.url)
+// applicationFiles returns the cloudinit files in state
+func applicationFiles(d *schema.ResourceData) []string {
+	files := make([]string, 0)
+	for _, file := range d.Get("cloudinits").([]interface{}) {
+		files = append(files, file.(string))
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Printf("failed to bind %d\n", resp.StatusCode)
-		return "", fmt.Errorf("[ERROR] failed to bind %d", resp.StatusCode)
+	if len(files) == 0 && d.Get("cloudinit").(string) != "" {
+		files = append(files, d.Get("cloudinit").(string))
 	}
-	respBind := &DeployToken{}
-	json.NewDecoder(resp.Body).Decode(respBind)
+	return files
+}
 
-	remote = []string{options.url, "deploy", "ns", options.namespace, "app", options.application}
-	byteData = make([]byte, 0)
-	req, _ = http.NewRequest("GET", strings.Join(remote, "/"), bytes.NewReader(byteData))
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", respBind.Token))
-	req.Header.Add("Content-Type", "application/json")
-	respApp, err := client.Do(req)
+// stringListEquals compares a list attribute with a list of strings
+func stringListEquals(raw []interface{}, values []string) bool {
+	if len(raw) != len(values) {
+		return false
+	}
+	for i, value := range values {
+		if raw[i].(string) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteStoreKeys deletes keys from deployment store, logging failures
+func deleteStoreKeys(options ApplicationOptions, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	runConcurrently(len(keys), func(i int) error {
+		if err := deleteStoreKey(options, keys[i]); err != nil {
+			log.Printf("[WARN] failed to delete key %s: %s", keys[i], err)
+		}
+		return nil
+	})
+}
+
+// applicationStoreOptions sets options needed to access deployment store
+func applicationStoreOptions(d resourceGetter, m interface{}) ApplicationOptions {
+	options := ApplicationOptions{}
+	options.url = m.(ProviderConfig).Address
+	if address := d.Get("address").(string); address != "" {
+		options.url = address
+	}
+	options.deployment = d.Get("deployment").(string)
+	options.deploymentToken = d.Get("deployment_token").(string)
+	options.deploymentAddress = d.Get("deployment_address").(string)
+	if options.deploymentAddress == "" {
+		options.deploymentAddress = options.url
+	}
+	return options
+}
+
+// getApplication fetches application from goterra-deploy
+func getApplication(options ApplicationOptions) (*terraModel.Application, error) {
+	remote := []string{options.url, "deploy", "ns", options.namespace, "app", options.application}
+	respApp, err := deployGet(options, remote)
 	if err != nil {
 		log.Printf("failed to contact server %s\n", options.url)
-		return "", fmt.Errorf("[ERROR] failed to contact server %s", options.url)
+		return nil, fmt.Errorf("[ERROR] failed to contact server %s", options.url)
 	}
 	defer respApp.Body.Close()
 	if respApp.StatusCode != 200 {
 		log.Printf("failed to get app %d\n", respApp.StatusCode)
-		return "", fmt.Errorf("[ERROR] failed to get app %d", respApp.StatusCode)
+		return nil, fmt.Errorf("[ERROR] failed to get app %d", respApp.StatusCode)
 	}
 	respAppInfo := &RespApplication{}
 	decerr := json.NewDecoder(respApp.Body).Decode(respAppInfo)
 	if decerr != nil {
 		log.Printf("[ERROR] decode error %s", decerr)
-		return "", fmt.Errorf("[ERROR] Decode error %s", decerr)
-	}
-	options.token = respBind.Token
-
-	loadedScripts := make(map[string]bool)
-	scripts := make([]terraModel.Recipe, 0)
-
-	// jr, _ := json.Marshal(respAppInfo)
-	// log.Printf("[INFO] app = %s", jr)
-
-	scriptTxt := goterraTmplPre + "\n"
-
-	if _, err := os.Stat("goterra.env"); err == nil {
-		dat, err := ioutil.ReadFile("goterra.env")
-		if err == nil {
-			var inputs map[string]string
-			if errJSON := json.Unmarshal(dat, &inputs); errJSON == nil {
-				for key, val := range inputs {
-					scriptTxt += fmt.Sprintf("export %s=%q\n", key, val)
-					if key == "ssh_pub_key" && val != "" {
-						quotedVal := strconv.Quote(val)
-						scriptTxt += fmt.Sprintf("echo %s >> ~/.ssh/authorized_keys\n", quotedVal)
-						// debian uses *debian* user, ubuntu the *ubuntu* user and centos *centos* user via their cloudinit setup
-						scriptTxt += "if [ -e /home/debian ];then\n"
-						scriptTxt += fmt.Sprintf("echo %s >> /home/debian/.ssh/authorized_keys\n", quotedVal)
-						scriptTxt += "fi\n"
-						scriptTxt += "if [ -e /home/ubuntu ];then\n"
-						scriptTxt += fmt.Sprintf("echo %s >> /home/ubuntu/.ssh/authorized_keys\n", quotedVal)
-						scriptTxt += "fi\n"
-						scriptTxt += "if [ -e /home/centos ];then\n"
-						scriptTxt += fmt.Sprintf("echo %s >> /home/centos/.ssh/authorized_keys\n", quotedVal)
-						scriptTxt += "fi\n"
-					}
-				}
-			}
-		}
-
+		return nil, fmt.Errorf("[ERROR] Decode error %s", decerr)
 	}
+	return &respAppInfo.App, nil
+}
 
-	gotName := fmt.Sprintf("%s-%d", respAppInfo.App.Name, time.Now().Unix())
-	if options.name != "" {
-		gotName = options.name
-	}
-
-	if options.recipes != nil && len(options.recipes) > 0 {
-		for _, appRecipe := range options.recipes {
-			recipe, err := getRecipe(options, appRecipe)
-			if err != nil {
-				log.Printf("[ERROR] Failed to get recipe")
-				return "", fmt.Errorf("[ERROR] failed to get recipe")
-			}
-			scriptTxt += fmt.Sprintf("\n#*** Apply recipe %s **********\n", recipe.Name)
-
-			if recipe.ParentRecipe != "" {
-				parentRecipes, err := getParentRecipe(options, recipe.ParentRecipe)
-				if err != nil {
-					log.Printf("[ERROR] Failed to get recipe")
-					return "", err
-				}
-				for _, parentRecipe := range parentRecipes {
-					if _, ok := loadedScripts[parentRecipe.Name]; ok {
-						// Already loaded
-					} else {
-						loadedScripts[parentRecipe.Name] = true
-						scripts = append(scripts, parentRecipe)
-						scriptTxt += fmt.Sprintf("\n#*** Load parent recipe %s:%s **********\n", parentRecipe.Name, parentRecipe.ID.Hex())
-					}
-				}
-			}
-
-			if _, ok := loadedScripts[recipe.Name]; ok {
-				// Already loaded
-			} else {
-				loadedScripts[recipe.Name] = true
-				scripts = append(scripts, *recipe)
-				scriptTxt += fmt.Sprintf("\n#*** Load recipe %s:%s **********\n", recipe.Name, recipe.ID.Hex())
-			}
-
-			// for i := len(scripts) - 1; i >= 0; i-- {
-			for i := 0; i < len(scripts); i++ {
-				scripts[i].Script = strings.Replace(scripts[i].Script, "${GOT_ID}", options.application, -1)
-				scripts[i].Script = strings.Replace(scripts[i].Script, "${GOT_URL}", options.deploymentAddress, -1)
-				scripts[i].Script = strings.Replace(scripts[i].Script, "${GOT_TOKEN}", options.deploymentToken, -1)
-				scripts[i].Script = strings.Replace(scripts[i].Script, "${GOT_DEP}", options.deployment, -1)
-				scripts[i].Script = strings.Replace(scripts[i].Script, "${GOT_NAME}", gotName, -1)
-
-				errRecipe := addRecipe(options, scripts[i].ID.Hex(), scripts[i].Script)
-				if errRecipe != nil {
-					return "", errRecipe
-				}
-				recipeIndex := "_recipe" + fmt.Sprintf("%s_%s", options.application, scripts[i].ID.Hex())
-				scriptTxt += "\n"
-				scriptTxt += fmt.Sprintf("if [ -f %s.done ]; then\n", recipeIndex)
-				scriptTxt += "    echo \"recipe already executed, skipping\"\n"
-				scriptTxt += "else\n"
-				scriptTxt += fmt.Sprintf("    /opt/got/goterra-cli --deployment ${GOT_DEP} --url ${GOT_URL} --token $TOKEN get %s > /opt/got/%s.sh\n", recipeIndex, recipeIndex)
-				scriptTxt += fmt.Sprintf("    dos2unix /opt/got/%s.sh\n", recipeIndex)
-				scriptTxt += fmt.Sprintf("    chmod +x /opt/got/%s.sh\n", recipeIndex)
-				scriptTxt += fmt.Sprintf("    /opt/got/%s.sh &>> /opt/got/${GOT_ID}.log\n", recipeIndex)
-				scriptTxt += fmt.Sprintf("    touch %s.done\n", recipeIndex)
-				scriptTxt += "fi\n"
-			}
-
-			scriptTxt += "\n#****************************\n"
+// AppCloudinit is the result of application cloudinit generation, files and setup names are per instance
+type AppCloudinit struct {
+	files      []string
+	gotNames   []string
+	recipes    []string
+	gotName    string
+	hash       string
+	recipeKeys []string
+}
 
-			scripts = make([]terraModel.Recipe, 0)
-		}
+func createApp(options ApplicationOptions) (*AppCloudinit, error) {
+	rendering, err := renderApp(options)
+	if err != nil {
+		return nil, err
 	}
 
-	scriptTxt = scriptTxt + "\n" + goterraTmpPost
-	// write cloudinit file
-	cloudinit = options.application + ".sh"
-	if options.name != "" {
-		cloudinit = fmt.Sprintf("%s-%s.sh", options.application, options.name)
+	entries := rendering.storeEntries()
+	errRecipes := runConcurrently(len(entries), func(i int) error {
+		return addRecipe(options, entries[i].key, entries[i].value)
+	})
+	if errRecipes != nil {
+		return nil, errRecipes
 	}
 
-	scriptTxt = strings.Replace(scriptTxt, "${GOT_ID}", options.application, -1)
-	scriptTxt = strings.Replace(scriptTxt, "${GOT_URL}", options.deploymentAddress, -1)
-	scriptTxt = strings.Replace(scriptTxt, "${GOT_TOKEN}", options.deploymentToken, -1)
-	scriptTxt = strings.Replace(scriptTxt, "${GOT_DEP}", options.deployment, -1)
-	scriptTxt = strings.Replace(scriptTxt, "${GOT_NAME}", gotName, -1)
-
-	errFile := ioutil.WriteFile(cloudinit, []byte(scriptTxt), 0644)
-	if errFile != nil {
-		return "", fmt.Errorf("[ERROR] failed to write cloudinit file")
+	// write cloudinit files
+	for _, instance := range rendering.instances {
+		errFile := ioutil.WriteFile(instance.file, []byte(instance.userData), 0644)
+		if errFile != nil {
+			return nil, fmt.Errorf("[ERROR] failed to write cloudinit file")
+		}
+	}
+	appCloudinit := &AppCloudinit{
+		files:      rendering.files(),
+		gotNames:   rendering.gotNames(),
+		recipes:    rendering.recipeIDs(),
+		gotName:    rendering.gotName,
+		hash:       rendering.hash,
+		recipeKeys: rendering.recipeKeys(),
 	}
-	return cloudinit, nil
+	return appCloudinit, nil
 }
 
+// addRecipe stores recipe in deployment store, unless key already has the same value
 func addRecipe(options ApplicationOptions, recipe string, script string) error {
+	existing, found, err := getStoreValue(options, recipe)
+	if err != nil {
+		log.Printf("[WARN] failed to check recipe %s: %s", recipe, err)
+	} else if found && existing == script {
+		log.Printf("[DEBUG] recipe %s already stored", recipe)
+		return nil
+	}
 	remote := []string{options.deploymentAddress, "store", options.deployment}
-	recipeData := DeploymentData{Key: "_recipe" + fmt.Sprintf("%s_%s", options.application, recipe), Value: script}
+	recipeData := DeploymentData{Key: recipe, Value: script}
 	byteData, _ := json.Marshal(recipeData)
 	req, _ := http.NewRequest("PUT", strings.Join(remote, "/"), bytes.NewBuffer(byteData))
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", options.deploymentToken))
@@ -411,66 +874,6 @@ func addRecipe(options ApplicationOptions, recipe string, script string) error {
 	return nil
 }
 
-func getParentRecipe(options ApplicationOptions, recipeID string) (recipes []terraModel.Recipe, err error) {
-	log.Printf("[INFO] load parent recipes of %s", recipeID)
-	recipes = make([]terraModel.Recipe, 0)
-	parentRecipe, err := getRecipe(options, recipeID)
-	if err != nil {
-		return recipes, fmt.Errorf("failed to get recipe %s", recipeID)
-	}
-	recipes = append(recipes, *parentRecipe)
-	hasParent := true
-	count := 0
-	for hasParent && count <= 1000 {
-		log.Printf("[INFO] parent = %s", parentRecipe.ParentRecipe)
-		if parentRecipe.ParentRecipe == "" {
-			log.Printf("[INFO] no parent")
-			hasParent = false
-		} else {
-			parentRecipe, err = getRecipe(options, parentRecipe.ParentRecipe)
-			if err != nil {
-				return recipes, fmt.Errorf("failed to get recipe %s", parentRecipe.ParentRecipe)
-			}
-			recipes = append(recipes, *parentRecipe)
-		}
-		count++
-	}
-	if count >= 1000 {
-		return recipes, fmt.Errorf("it seems there is an infinite loop on recipes")
-	}
-	log.Printf("[INFO] Parent recipes %+v\n", recipes)
-	return recipes, nil
-}
-
-func getRecipe(options ApplicationOptions, recipeID string) (recipe *terraModel.Recipe, err error) {
-	log.Printf("[INFO] load recipe %s", recipeID)
-	remote := []string{options.url, "deploy", "ns", options.namespace, "recipe", recipeID}
-	byteData := make([]byte, 0)
-	req, _ := http.NewRequest("GET", strings.Join(remote, "/"), bytes.NewReader(byteData))
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", options.token))
-	req.Header.Add("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to contact server %s\n", options.url)
-		return nil, fmt.Errorf("Failed to get recipe %s", recipeID)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Printf("failed to create deployment %d\n", resp.StatusCode)
-		return nil, fmt.Errorf("Failed to get recipe %s", recipeID)
-	}
-	resprecipe := &RespRecipe{}
-	json.NewDecoder(resp.Body).Decode(resprecipe)
-	log.Printf("[DEBUG] fetched recipe %s", resprecipe.Recipe.Name)
-	recipe = &resprecipe.Recipe
-	return recipe, nil
-}
-
-type RespRecipe struct {
-	Recipe terraModel.Recipe `json:"recipe"`
-}
-
 type RespApplication struct {
 	App terraModel.Application `json:"app"`
 }
@@ -484,8 +887,31 @@ type ApplicationOptions struct {
 	deploymentAddress string
 	application       string
 	namespace         string
-	token             string
 	name              string
+	gotName           string
 	recipeTags        []string
 	recipes           []string
+	localRecipes      []LocalRecipe
+	cliVersion        string
+	cliURL            string
+	cliSHA256         string
+	cliOS             string
+	cliArch           string
+	client            string
+	inputs            map[string]string
+	variables         map[string]string
+	instances         int
+	embedRecipes      bool
+	bootstrapMode     string
+	maxUserDataBytes  int
+	timeout           int
+	retries           int
+	recipePolicies    []RecipePolicy
+	logInterval       int
+	logMaxBytes       int
+	instanceSpecs     []InstanceOptions
+	cache             *RecipeCache
+	sessions          *SessionCache
+	trustedKeys       []ed25519.PublicKey
+	sshKeys           []SSHAuthorizedKeys
 }
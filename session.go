@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSessionTTL is the session lifetime used when token does not define an expiration
+const defaultSessionTTL = 30 * time.Minute
+
+// sessionExpiryMargin renews tokens a bit before their expiration
+const sessionExpiryMargin = 1 * time.Minute
+
+// DeployToken is deploy bind answer
+type DeployToken struct {
+	Token string `json:"token"`
+}
+
+// session is a bound deploy token
+type session struct {
+	token   string
+	expires time.Time
+}
+
+// SessionCache keeps deploy tokens per goterra address and API key
+type SessionCache struct {
+	mutex    sync.Mutex
+	sessions map[string]session
+}
+
+func newSessionCache() *SessionCache {
+	return &SessionCache{sessions: make(map[string]session)}
+}
+
+func sessionKey(options ApplicationOptions) string {
+	return options.url + "\n" + options.apikey
+}
+
+// sessionToken returns a deploy token for options address and API key, binding a new session
+// if none is cached or cached one is expired
+func sessionToken(options ApplicationOptions) (string, error) {
+	sessions := options.sessions
+	if sessions == nil {
+		return bindSession(options)
+	}
+	key := sessionKey(options)
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if cached, ok := sessions.sessions[key]; ok && time.Now().Add(sessionExpiryMargin).Before(cached.expires) {
+		return cached.token, nil
+	}
+	token, err := bindSession(options)
+	if err != nil {
+		return "", err
+	}
+	expires := tokenExpiration(token)
+	log.Printf("[DEBUG] new session bound for %s, expires at %s", options.url, expires)
+	sessions.sessions[key] = session{token: token, expires: expires}
+	return token, nil
+}
+
+// invalidateSession removes token from cache, if still the cached one
+func invalidateSession(options ApplicationOptions, token string) {
+	sessions := options.sessions
+	if sessions == nil {
+		return
+	}
+	key := sessionKey(options)
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if cached, ok := sessions.sessions[key]; ok && cached.token == token {
+		delete(sessions.sessions, key)
+	}
+}
+
+// tokenExpiration reads expiration of a JWT token, defaulting to defaultSessionTTL
+func tokenExpiration(token string) time.Time {
+	defaultExpiration := time.Now().Add(defaultSessionTTL)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return defaultExpiration
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return defaultExpiration
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return defaultExpiration
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// bindSession exchanges user API key for a deploy token
+func bindSession(options ApplicationOptions) (string, error) {
+	client := &http.Client{}
+	remote := []string{options.url, "deploy", "session", "bind"}
+	byteData := make([]byte, 0)
+	req, _ := http.NewRequest("POST", strings.Join(remote, "/"), bytes.NewReader(byteData))
+	req.Header.Add("X-API-Key", options.apikey)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.url)
+		return "", fmt.Errorf("[ERROR] failed to contact server %s", options.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("failed to bind %d\n", resp.StatusCode)
+		return "", fmt.Errorf("[ERROR] failed to bind %d", resp.StatusCode)
+	}
+	respBind := &DeployToken{}
+	json.NewDecoder(resp.Body).Decode(respBind)
+	return respBind.Token, nil
+}
+
+// deployGet sends a GET request to goterra-deploy with session token
+//
+// If server answers 401, session is bound again and request sent once more.
+func deployGet(options ApplicationOptions, remote []string) (*http.Response, error) {
+	client := &http.Client{}
+	for attempt := 0; ; attempt++ {
+		token, err := sessionToken(options)
+		if err != nil {
+			return nil, err
+		}
+		req, _ := http.NewRequest("GET", strings.Join(remote, "/"), nil)
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Add("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 401 || attempt > 0 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Printf("[INFO] session token rejected, binding a new session")
+		invalidateSession(options, token)
+	}
+}
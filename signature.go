@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signatureRegexp matches the signature line of a recipe script
+var signatureRegexp = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*goterra:signature[ \t]+(\S+)[ \t]*(\r?\n|$)`)
+
+// parseTrustedKeys decodes base64 ed25519 public keys
+func parseTrustedKeys(raw []interface{}) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(raw))
+	for _, rawKey := range raw {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rawKey.(string)))
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %s, expecting a base64 encoded ed25519 public key", rawKey.(string))
+		}
+		keys = append(keys, ed25519.PublicKey(decoded))
+	}
+	return keys, nil
+}
+
+// verifyRecipeSignature checks recipe script is signed by one of trusted keys
+//
+// Signature is a `# goterra:signature <base64 signature>` line of the script,
+// signed content being the script without this line.
+func verifyRecipeSignature(recipe terraModel.Recipe, trustedKeys []ed25519.PublicKey) error {
+	match := signatureRegexp.FindStringSubmatchIndex(recipe.Script)
+	if match == nil {
+		return fmt.Errorf("recipe %s:%s is not signed", recipe.Name, recipe.ID.Hex())
+	}
+	signature, err := base64.StdEncoding.DecodeString(recipe.Script[match[2]:match[3]])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("recipe %s:%s has an invalid signature", recipe.Name, recipe.ID.Hex())
+	}
+	content := recipe.Script[:match[0]] + recipe.Script[match[1]:]
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, []byte(content), signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature of recipe %s:%s does not match any trusted key", recipe.Name, recipe.ID.Hex())
+}
+
+// verifyRecipes checks signature of server recipes, and recipes they include, if trusted keys are set
+//
+// Local recipes are not verified.
+func verifyRecipes(options ApplicationOptions, recipes []ResolvedRecipe) error {
+	if len(options.trustedKeys) == 0 {
+		return nil
+	}
+	for _, recipe := range recipes {
+		if strings.HasPrefix(recipe.id, localRecipePrefix) {
+			log.Printf("[INFO] local recipe %s is not verified", recipe.name)
+		}
+		for _, source := range recipe.sources {
+			if err := verifyRecipeSignature(source, options.trustedKeys); err != nil {
+				log.Printf("[ERROR] %s", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	terraModel "github.com/osallou/goterra-lib/lib/model"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifyRecipeSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "#!/bin/bash\necho hello\n"
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(content)))
+	otherSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivateKey, []byte(content)))
+	signatureLine := "# goterra:signature " + signature + "\n"
+
+	tests := []struct {
+		name   string
+		script string
+		keys   []ed25519.PublicKey
+		fails  bool
+	}{
+		{"signed", signatureLine + content, []ed25519.PublicKey{publicKey}, false},
+		{"signature at end", content + signatureLine, []ed25519.PublicKey{publicKey}, false},
+		{"signature without newline", content + strings.TrimSuffix(signatureLine, "\n"), []ed25519.PublicKey{publicKey}, false},
+		{"one of trusted keys", signatureLine + content, []ed25519.PublicKey{otherPublicKey, publicKey}, false},
+		{"tampered", signatureLine + content + "rm -rf /\n", []ed25519.PublicKey{publicKey}, true},
+		{"untrusted key", "# goterra:signature " + otherSignature + "\n" + content, []ed25519.PublicKey{publicKey}, true},
+		{"unsigned", content, []ed25519.PublicKey{publicKey}, true},
+		{"invalid signature", "# goterra:signature notbase64!\n" + content, []ed25519.PublicKey{publicKey}, true},
+		{"truncated signature", "# goterra:signature " + signature[:20] + "\n" + content, []ed25519.PublicKey{publicKey}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recipe := terraModel.Recipe{Name: "test", Script: test.script}
+			err := verifyRecipeSignature(recipe, test.keys)
+			if test.fails && err == nil {
+				t.Errorf("verification should fail")
+			}
+			if !test.fails && err != nil {
+				t.Errorf("verification failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestParseTrustedKeys(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	keys, err := parseTrustedKeys([]interface{}{encoded})
+	if err != nil || len(keys) != 1 {
+		t.Errorf("parseTrustedKeys failed: %v", err)
+	}
+	if _, err := parseTrustedKeys([]interface{}{encoded[:10]}); err == nil {
+		t.Errorf("parseTrustedKeys should fail on invalid key")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// goterraSSHFunctions defines functions adding ssh keys to users
+const goterraSSHFunctions string = `got_add_ssh_key () {
+	local home group
+	home=$(getent passwd "$1" | cut -d: -f6)
+	if [ -z "$home" ]; then
+		echo "[WARN] user $1 not found, skipping ssh key"
+		return 0
+	fi
+	group=$(id -gn "$1")
+	mkdir -p "$home/.ssh"
+	touch "$home/.ssh/authorized_keys"
+	grep -qxF "$2" "$home/.ssh/authorized_keys" || echo "$2" >> "$home/.ssh/authorized_keys"
+	chown "$1:$group" "$home/.ssh" "$home/.ssh/authorized_keys"
+	chmod 700 "$home/.ssh"
+	chmod 600 "$home/.ssh/authorized_keys"
+	if [ -n "$(command -v restorecon)" ]; then
+		restorecon -R "$home/.ssh" || true
+	fi
+}
+
+got_login_users () {
+	echo root
+	getent passwd | awk -F: '$3 >= 1000 && $3 < 65534 && $7 !~ /(nologin|false)$/ {print $1}'
+}
+`
+
+// SSHAuthorizedKeys are public keys to add to a user, or to all login users if user is empty
+type SSHAuthorizedKeys struct {
+	user string
+	keys []string
+}
+
+// sshAuthorizedKeysSchema defines ssh_authorized_keys blocks
+func sshAuthorizedKeysSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"user": &schema.Schema{
+					Type:        schema.TypeString,
+					Optional:    true,
+					Description: "User to add keys to, all login users if empty",
+				},
+				"keys": &schema.Schema{
+					Type: schema.TypeList,
+					Elem: &schema.Schema{
+						Type: schema.TypeString,
+					},
+					Required: true,
+				},
+			},
+		},
+	}
+}
+
+// sshAuthorizedKeys reads ssh_authorized_keys blocks, removing duplicate keys per user
+func sshAuthorizedKeys(raw []interface{}) []SSHAuthorizedKeys {
+	sshKeys := make([]SSHAuthorizedKeys, 0)
+	userIndex := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, rawBlock := range raw {
+		block := rawBlock.(map[string]interface{})
+		user := block["user"].(string)
+		index, ok := userIndex[user]
+		if !ok {
+			index = len(sshKeys)
+			userIndex[user] = index
+			sshKeys = append(sshKeys, SSHAuthorizedKeys{user: user, keys: make([]string, 0)})
+		}
+		for _, rawKey := range block["keys"].([]interface{}) {
+			key := strings.TrimSpace(rawKey.(string))
+			if key == "" || seen[user+"\n"+key] {
+				continue
+			}
+			seen[user+"\n"+key] = true
+			sshKeys[index].keys = append(sshKeys[index].keys, key)
+		}
+	}
+	return sshKeys
+}
+
+// sshKeysScript generates the script part adding ssh keys to users
+func sshKeysScript(sshKeys []SSHAuthorizedKeys) string {
+	if len(sshKeys) == 0 {
+		return ""
+	}
+	script := goterraSSHFunctions + "\n"
+	for _, userKeys := range sshKeys {
+		for _, key := range userKeys.keys {
+			if userKeys.user == "" {
+				script += "for got_user in $(got_login_users); do\n"
+				script += fmt.Sprintf("    got_add_ssh_key \"$got_user\" %s\n", shellQuote(key))
+				script += "done\n"
+			} else {
+				script += fmt.Sprintf("got_add_ssh_key %s %s\n", shellQuote(userKeys.user), shellQuote(key))
+			}
+		}
+	}
+	return script
+}
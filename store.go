@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// getStoreValue gets a key value in deployment store, found is false if key does not exist
+func getStoreValue(options ApplicationOptions, key string) (value string, found bool, err error) {
+	remote := []string{options.deploymentAddress, "store", options.deployment, key}
+	req, _ := http.NewRequest("GET", strings.Join(remote, "/"), nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", options.deploymentToken))
+	req.Header.Add("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.deploymentAddress)
+		return "", false, fmt.Errorf("[ERROR] Failed to get key %s: %s", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return "", false, nil
+	}
+	if resp.StatusCode != 200 {
+		return "", false, fmt.Errorf("[ERROR] Failed to get key %s: %d", key, resp.StatusCode)
+	}
+	respData := &KeyValue{}
+	if err := json.NewDecoder(resp.Body).Decode(respData); err != nil {
+		return "", false, fmt.Errorf("[ERROR] Failed to decode key %s: %s", key, err)
+	}
+	return respData.Value, true, nil
+}
+
+// deleteStoreKey deletes a key in deployment store, missing keys are ignored
+func deleteStoreKey(options ApplicationOptions, key string) error {
+	remote := []string{options.deploymentAddress, "store", options.deployment, key}
+	req, _ := http.NewRequest("DELETE", strings.Join(remote, "/"), nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", options.deploymentToken))
+	req.Header.Add("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.deploymentAddress)
+		return fmt.Errorf("[ERROR] Failed to delete key %s: %s", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return fmt.Errorf("[ERROR] Failed to delete key %s: %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// listStoreKeys lists the keys of deployment store
+//
+// Store answers either a key/value object or a list of key/value objects.
+func listStoreKeys(options ApplicationOptions) ([]string, error) {
+	remote := []string{options.deploymentAddress, "store", options.deployment}
+	req, _ := http.NewRequest("GET", strings.Join(remote, "/"), nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", options.deploymentToken))
+	req.Header.Add("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("failed to contact server %s\n", options.deploymentAddress)
+		return nil, fmt.Errorf("[ERROR] Failed to list deployment %s: %s", options.deployment, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return []string{}, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("[ERROR] Failed to list deployment %s: %d", options.deployment, resp.StatusCode)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to decode deployment %s: %s", options.deployment, err)
+	}
+	keys := make([]string, 0)
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &values); err == nil {
+		for key := range values {
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+	keyValues := make([]KeyValue, 0)
+	if err := json.Unmarshal(raw, &keyValues); err != nil {
+		return nil, fmt.Errorf("[ERROR] Failed to decode deployment %s: %s", options.deployment, err)
+	}
+	for _, keyValue := range keyValues {
+		keys = append(keys, keyValue.Key)
+	}
+	return keys, nil
+}